@@ -0,0 +1,167 @@
+package pool
+
+import (
+	"errors"
+	"time"
+)
+
+// shrinkUtilization below which policies shrink a stage with empty job que
+const shrinkUtilization = 0.5
+
+// Autoscale workers of a stage between MinSize and MaxSize, Config.Size is the initial size
+type Autoscale struct {
+	MinSize int
+	MaxSize int
+	// Policy decides size of the stage every Interval
+	Policy ScalePolicy
+	// Interval between evaluations of Policy, defaults to 1 second when 0
+	Interval time.Duration
+	// Cooldown after resizing the stage during which Policy is not evaluated
+	Cooldown time.Duration
+}
+
+// ScaleMetrics of a stage since last evaluation of ScalePolicy
+type ScaleMetrics struct {
+	// Size is current number of workers
+	Size int
+	// QueueDepth is number of jobs waiting in job que of the stage, QueueLimit is its capacity
+	QueueDepth int
+	QueueLimit int
+	// Processed jobs, including failed ones
+	Processed int
+	// Utilization is fraction of time workers spent processing jobs
+	Utilization float64
+	// Latency is average time spent processing a job including retries
+	Latency time.Duration
+	// Wait is estimated time a job waits in job que, from QueueDepth and throughput
+	Wait time.Duration
+}
+
+// ScalePolicy returns desired size of a stage, size is clamped to MinSize and MaxSize of Autoscale
+type ScalePolicy func(metrics ScaleMetrics) int
+
+// QueueDepthPolicy grows stage by one worker while more than threshold jobs are queued and shrinks it by one while
+// job que is empty and workers are busy less than half of the time
+func QueueDepthPolicy(threshold int) ScalePolicy {
+	return func(m ScaleMetrics) int {
+		if m.QueueDepth > threshold {
+			return m.Size + 1
+		}
+		if m.QueueDepth == 0 && m.Utilization < shrinkUtilization {
+			return m.Size - 1
+		}
+		return m.Size
+	}
+}
+
+// TargetLatencyPolicy grows stage by one worker while jobs wait in job que longer than target and shrinks it by one
+// while job que is empty and workers are busy less than half of the time
+func TargetLatencyPolicy(target time.Duration) ScalePolicy {
+	return func(m ScaleMetrics) int {
+		if m.Wait > target {
+			return m.Size + 1
+		}
+		if m.QueueDepth == 0 && m.Utilization < shrinkUtilization {
+			return m.Size - 1
+		}
+		return m.Size
+	}
+}
+
+// AIMDPolicy adds increase workers while jobs are queued and multiplies size by decrease while processing a job
+// takes longer than target, e.g. when a downstream service is overloaded. decrease is expected between 0 and 1
+func AIMDPolicy(target time.Duration, increase int, decrease float64) ScalePolicy {
+	return func(m ScaleMetrics) int {
+		if m.Processed > 0 && m.Latency > target {
+			return int(float64(m.Size) * decrease)
+		}
+		if m.QueueDepth > 0 {
+			return m.Size + increase
+		}
+		return m.Size
+	}
+}
+
+func (a *Autoscale) validate(size int) error {
+	if a.MinSize <= 0 {
+		return errors.New("expected Autoscale.MinSize to be more than 0")
+	}
+	if a.MaxSize < a.MinSize {
+		return errors.New("expected Autoscale.MaxSize to be MinSize or more")
+	}
+	if size < a.MinSize || size > a.MaxSize {
+		return errors.New("expected pool size to be between Autoscale.MinSize and MaxSize")
+	}
+	if a.Policy == nil {
+		return errors.New("expected Autoscale.Policy to be not nil")
+	}
+	if a.Interval < 0 || a.Cooldown < 0 {
+		return errors.New("expected Autoscale.Interval and Cooldown to be 0 or more")
+	}
+	return nil
+}
+
+// clamp size to MinSize and MaxSize
+func (a *Autoscale) clamp(size int) int {
+	if size < a.MinSize {
+		return a.MinSize
+	}
+	if size > a.MaxSize {
+		return a.MaxSize
+	}
+	return size
+}
+
+// autoscale stage as per a until all its workers exit
+func (p *singleStagePool[J, R]) autoscale(a *Autoscale) {
+	interval := a.Interval
+	if interval == 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var resized time.Time
+	last, prev := time.Now(), p.stats()
+	for {
+		select {
+		case <-p.exited:
+			return
+		case now := <-ticker.C:
+			stats := p.stats()
+			m := scaleMetrics(now.Sub(last), prev, stats)
+			_, m.QueueLimit = p.queue()
+			last, prev = now, stats
+			// queue of a paused stage grows without workers being busy
+			if stats.Paused || now.Sub(resized) < a.Cooldown {
+				continue
+			}
+			if size := a.clamp(a.Policy(m)); size != m.Size {
+				// workers that failed to init are retried after cooldown
+				if p.resize(size) == ErrPoolClosed {
+					return
+				}
+				resized = now
+			}
+		}
+	}
+}
+
+// scaleMetrics of a stage from its stats elapsed time apart
+func scaleMetrics(elapsed time.Duration, prev, stats StageStats) ScaleMetrics {
+	processed, busy := stats.Processed-prev.Processed, stats.Busy-prev.Busy
+	m := ScaleMetrics{
+		Size:       stats.Size,
+		QueueDepth: stats.QueueDepth,
+		Processed:  int(processed),
+	}
+	if elapsed > 0 && m.Size > 0 {
+		m.Utilization = float64(busy) / float64(elapsed*time.Duration(m.Size))
+	}
+	if processed > 0 {
+		m.Latency = busy / time.Duration(processed)
+		m.Wait = elapsed * time.Duration(m.QueueDepth) / time.Duration(processed)
+	} else if m.QueueDepth > 0 {
+		m.Wait = elapsed
+	}
+	return m
+}
@@ -0,0 +1,172 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Batch returns a new Builder with a stage added to b that groups results of b into batches of up to maxSize,
+// a batch is flushed once it is full, maxLinger passed since its first result or results of b are closed.
+// maxLinger 0 means batches are flushed only when full or closed.
+//
+// A batch carries JobID of its first job. Futures of other submitted jobs in the batch resolve with ErrBatched.
+// In ordered pools results of a batch are ordered by its first job, unless it is followed by Unbatch which returns
+// every value to the job it originates from
+func Batch[J, T any](b *Builder[J, T], maxSize int, maxLinger time.Duration) *Builder[J, []T] {
+	next := &Builder[J, []T]{
+		validators: append(append([]func() error(nil), b.validators...), func() error {
+			if maxSize <= 0 {
+				return errors.New("expected batch size to be more than 0")
+			}
+			if maxLinger < 0 {
+				return errors.New("expected batch linger to be 0 or more")
+			}
+			return nil
+		}),
+		names:            append(append([]string(nil), b.names...), "batch"),
+		first:            b.first,
+		resultQueueLimit: b.resultQueueLimit,
+	}
+	if b.start == nil {
+		return next
+	}
+	stage := len(next.names)
+	next.start = func(r *run, jobs <-chan item[J], last bool) <-chan item[[]T] {
+		batches := make(chan item[[]T])
+		in := b.start(r, jobs, false)
+		r.spawn(func() {
+			batch(r, r.stage(stage), in, batches, maxSize, maxLinger)
+		})
+		return batches
+	}
+	return next
+}
+
+// Unbatch returns a new Builder with a stage added to b that passes every result in batches of b to next stage
+func Unbatch[J, T any](b *Builder[J, []T]) *Builder[J, T] {
+	next := &Builder[J, T]{
+		validators:       append([]func() error(nil), b.validators...),
+		names:            append(append([]string(nil), b.names...), "unbatch"),
+		first:            b.first,
+		resultQueueLimit: b.resultQueueLimit,
+	}
+	if b.start == nil {
+		return next
+	}
+	stage := len(next.names)
+	next.start = func(r *run, jobs <-chan item[J], last bool) <-chan item[T] {
+		results := make(chan item[T])
+		in := b.start(r, jobs, false)
+		r.spawn(func() {
+			unbatch(r, r.stage(stage), in, results)
+		})
+		return results
+	}
+	return next
+}
+
+func batch[T any](r *run, stage int, in <-chan item[T], out chan<- item[[]T], maxSize int, maxLinger time.Duration) {
+	defer close(out)
+	var (
+		values  []T
+		parts   []part
+		timer   *time.Timer
+		timeout <-chan time.Time
+	)
+	flush := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, timeout = nil, nil
+		}
+		if len(values) == 0 {
+			return
+		}
+		first := parts[0]
+		next := item[[]T]{id: first.id, value: values, ctx: first.ctx, offset: first.offset, weight: first.weight}
+		if r.ordered {
+			next.parts = parts
+		}
+		if !send(r.ctx, out, next) {
+			// record jobs of the batch individually as they can not be retried as batch
+			for index, value := range values {
+				r.errors.add(r.ctx, JobError{Job: value, JobID: parts[index].id, Stage: stage, StageName: "batch", Err: r.ctx.Err(), Failed: time.Now()})
+			}
+		}
+		values, parts = nil, nil
+	}
+	for {
+		select {
+		case next, ok := <-in:
+			if !ok {
+				flush()
+				return
+			}
+			if next.skip {
+				send(r.ctx, out, item[[]T]{id: next.id, ctx: next.ctx, offset: next.offset, weight: next.weight, skip: true})
+				continue
+			}
+			if len(values) == 0 {
+				if maxLinger > 0 {
+					timer = time.NewTimer(maxLinger)
+					timeout = timer.C
+				}
+			} else if next.ctx != nil && next.id != parts[0].id {
+				r.errors.resolveOnly(JobError{Job: next.value, JobID: next.id, Stage: stage, StageName: "batch", Err: ErrBatched})
+			}
+			values = append(values, next.value)
+			parts = append(parts, part{id: next.id, ctx: next.ctx, offset: next.offset, weight: next.weight})
+			if len(values) >= maxSize {
+				flush()
+			}
+		case <-timeout:
+			flush()
+		}
+	}
+}
+
+func unbatch[T any](r *run, stage int, in <-chan item[[]T], out chan<- item[T]) {
+	defer close(out)
+	for batch := range in {
+		if batch.skip || len(batch.value) == 0 {
+			if r.ordered {
+				send(r.ctx, out, item[T]{id: batch.id, ctx: batch.ctx, offset: batch.offset, weight: batch.weight, skip: true})
+				for _, part := range batch.batched() {
+					send(r.ctx, out, skipped[T](part))
+				}
+			}
+			continue
+		}
+		for index, value := range batch.value {
+			next := item[T]{id: batch.id, value: value, ctx: batch.ctx}
+			if len(batch.parts) == len(batch.value) {
+				// in ordered pools values of a batch return to jobs they originate from, except for submitted
+				// jobs resolved with ErrBatched
+				part := batch.parts[index]
+				next = item[T]{id: part.id, value: value, ctx: part.ctx, offset: part.offset, weight: part.weight}
+				next.skip = part.ctx != nil && part.id != batch.id
+			} else {
+				next.offset, next.weight = batch.split(len(batch.value), index)
+			}
+			if !send(r.ctx, out, next) {
+				r.errors.add(r.ctx, JobError{Job: batch.value[index:], JobID: batch.id, Stage: stage, StageName: "unbatch", Err: r.ctx.Err(), Failed: time.Now()})
+				break
+			}
+		}
+	}
+}
+
+// send next to out, returns false if ctx is done before it can be sent
+func send[T any](ctx context.Context, out chan<- T, next T) bool {
+	select {
+	case out <- next:
+		return true
+	default:
+	}
+	select {
+	case out <- next:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
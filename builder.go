@@ -0,0 +1,147 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Builder of a pool with any number of chained stages, results of a stage are jobs of the next stage.
+// Start with From and add stages with Then
+//
+//	p, err := pool.Then(pool.Then(pool.From(config1), config2), config3).Build(ctx)
+type Builder[J, R any] struct {
+	validators []func() error
+	names      []string
+	// settings of pool from first stage
+	first firstStage
+	// limit of results channel of last stage
+	resultQueueLimit int
+	// start stages, returns results channel of last stage which is unbuffered if last is true
+	start func(r *run, jobs <-chan item[J], last bool) <-chan item[R]
+}
+
+// firstStage settings that apply to the whole pool
+type firstStage struct {
+	// limits of job que and errors channel
+	jobQueueLimit, errorQueueLimit int
+	// orderWindow of ordered pool, 0 if pool is not ordered
+	orderWindow int
+	// priority and aging of job que
+	priority bool
+	aging    time.Duration
+	// scheduled is true if jobs are scheduled by key
+	scheduled bool
+	// tee is true if jobs are teed to several branches, stages then pass on intervals of jobs
+	tee bool
+}
+
+// From returns Builder with config for the first stage of the pool
+func From[J, R any](config *Config[J, R]) *Builder[J, R] {
+	b := &Builder[J, R]{
+		validators: []func() error{validator(config)},
+	}
+	if config == nil {
+		return b
+	}
+	b.names = []string{config.Name}
+	b.first = firstStage{
+		jobQueueLimit:   config.JobQueueLimit,
+		errorQueueLimit: config.ErrorQueueLimit,
+		priority:        config.Priority,
+		aging:           config.PriorityAging,
+		scheduled:       config.SerializeByKey || config.FairByKey,
+	}
+	b.resultQueueLimit = config.ResultQueueLimit
+	if config.Ordered {
+		b.first.orderWindow = config.OrderWindow
+		if b.first.orderWindow == 0 {
+			b.first.orderWindow = config.JobQueueLimit
+		}
+	}
+	b.start = func(r *run, jobs <-chan item[J], last bool) <-chan item[R] {
+		return startStage(r, config, r.stage(1), jobs, last)
+	}
+	return b
+}
+
+// Then returns a new Builder with config for next stage added to b, config job type must be result type of b
+func Then[J, R1, R2 any](b *Builder[J, R1], config *Config[R1, R2]) *Builder[J, R2] {
+	next := &Builder[J, R2]{
+		validators: append(append([]func() error(nil), b.validators...), validator(config)),
+		names:      append(append([]string(nil), b.names...), ""),
+		first:      b.first,
+	}
+	if config == nil || b.start == nil {
+		return next
+	}
+	stage := len(next.names)
+	next.names[stage-1] = config.Name
+	next.resultQueueLimit = config.ResultQueueLimit
+	next.start = func(r *run, jobs <-chan item[J], last bool) <-chan item[R2] {
+		return startStage(r, config, r.stage(stage), b.start(r, jobs, false), last)
+	}
+	return next
+}
+
+// Build validates config of all stages, creates pool and starts workers
+func (b *Builder[J, R]) Build(ctx context.Context) (Pool[J, R], error) {
+	for _, validate := range b.validators {
+		if err := validate(); err != nil {
+			return nil, err
+		}
+	}
+	jobQueueLimit := b.first.jobQueueLimit
+	if b.first.priority || b.first.scheduled {
+		// jobs are queued by priority or key instead of in jobs channel
+		jobQueueLimit = 0
+	}
+	p := newPipeline[J, R](ctx, jobQueueLimit, b.resultQueueLimit, b.first.errorQueueLimit, b.first.orderWindow, b.names...)
+	// futures of teed jobs are resolved once results of all copies are accounted for by their intervals
+	p.ordered = p.ordered || b.first.tee
+	var jobs <-chan item[J] = p.jobs
+	if b.first.priority || b.first.scheduled {
+		p.slots = make(chan struct{}, b.first.jobQueueLimit)
+	}
+	if b.first.priority {
+		jobs = prioritize(p.run, p.jobs, b.first.jobQueueLimit, b.first.aging)
+	}
+	p.start(b.start(p.run, jobs, true))
+	if err := p.init.result(); err != nil {
+		// workers that initialized exit and close their state
+		p.closeJobs()
+		p.goroutines.Wait()
+		return nil, err
+	}
+	return p, nil
+}
+
+func validator[J, R any](config *Config[J, R]) func() error {
+	return func() error {
+		if config == nil {
+			return errors.New("expected config to be not nil")
+		}
+		return newStage(config).validate()
+	}
+}
+
+func newStage[J, R any](config *Config[J, R]) *singleStagePool[J, R] {
+	return &singleStagePool[J, R]{
+		Config:  config,
+		running: config.Size,
+		mutex:   sync.Mutex{},
+	}
+}
+
+// startStage with config reading jobs channel, returns its results channel which is unbuffered for last stage
+// as pipeline buffers results of last stage
+func startStage[J, R any](r *run, config *Config[J, R], stage int, jobs <-chan item[J], last bool) <-chan item[R] {
+	limit := config.ResultQueueLimit
+	if last {
+		limit = 0
+	}
+	s := newStage(config)
+	s.startPool(r, stage, jobs, make(chan item[R], limit))
+	return s.results
+}
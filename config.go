@@ -1,43 +1,164 @@
 package pool
 
-import "context"
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Deadliner can be implemented by job type to set a deadline for processing the job, including all retries
+type Deadliner interface {
+	Deadline() (deadline time.Time, ok bool)
+}
 
 // Config for a worker pool,
 type Config[J, R any] struct {
+	// Name of the pool or stage in chained pools, used in JobError
+	Name string
 	// Size of the pool
 	Size int
-	// MaxRetry for failed jobs, it is cumulative for all jobs
+	// MaxRetry for failed jobs, it is cumulative for all jobs. Ignored when RetryPolicy is set
 	MaxRetry int
+	// RetryPolicy for failed jobs, gives every job its own attempt budget with backoff between attempts
+	RetryPolicy *RetryPolicy
+	// Retryable classifies errors returned by Worker, errors for which it returns false are not retried.
+	// Errors wrapped with Permanent are never retried
+	Retryable func(err error) bool
 	// JobQueueLimit for jobs channel, will block SendJobs call until full
 	JobQueueLimit int
 	// ResultQueueLimit for results channel, will block SendJobs call until full
 	ResultQueueLimit int
-	// HandlePanic for jobs that fail with panic
+	// JobTimeout for every Worker invocation, timed out jobs fail with error wrapping context.DeadlineExceeded.
+	// 0 means no timeout
+	JobTimeout time.Duration
+	// ErrorQueueLimit for channel returned by Pool.ErrorsChan, workers block on a full channel until errors are
+	// received or pool context is done. For chained pools limit of the first stage is used
+	ErrorQueueLimit int
+	// Ordered sends results in order jobs were sent instead of order of completion. For chained pools setting of
+	// first stage is used
+	Ordered bool
+	// OrderWindow limits jobs in flight of ordered pool, sending jobs blocks while a job holds up results of
+	// OrderWindow jobs sent after it. Defaults to JobQueueLimit when 0
+	OrderWindow int
+	// Priority processes queued jobs with highest priority first instead of in order they were sent, priority is set
+	// with SendJobsPriority or by job types implementing Prioritized. For chained pools setting of first stage is used
+	Priority bool
+	// PriorityAging raises priority of a queued job by 1 for every PriorityAging it waits so jobs with low priority
+	// are not starved, 0 disables aging
+	PriorityAging time.Duration
+	// Rate limits jobs started per second by workers of the stage with bursts of up to Burst jobs, every attempt of
+	// a job takes a token. 0 means no limit, Burst defaults to 1 when 0
+	Rate  float64
+	Burst int
+	// RateLimiter shared with other stages or pools, used instead of Rate and Burst
+	RateLimiter *RateLimiter
+	// SerializeByKey processes jobs with same key one at a time in order they were sent, jobs with different keys are
+	// processed in parallel. Key is returned by KeyFunc or by job types implementing Keyed. Up to JobQueueLimit jobs
+	// wait for their key
+	SerializeByKey bool
+	// FairByKey starts jobs of different keys, e.g. tenants, in weighted round-robin so a key with many queued jobs
+	// can not starve others. Jobs of a key are started in order they were sent. Up to JobQueueLimit jobs are queued
+	FairByKey bool
+	// MaxPerKey limits jobs of a key processed at the same time with FairByKey, 0 means no limit
+	MaxPerKey int
+	// KeyWeight returns weight of a key with FairByKey, a key gets up to weight jobs started per turn. nil or weight
+	// less than 1 means weight 1
+	KeyWeight func(key string) int
+	// KeyFunc returns key of a job for SerializeByKey and FairByKey
+	KeyFunc func(job J) string
+	// Autoscale workers between a minimum and maximum size as per a ScalePolicy, nil means fixed Size
+	Autoscale *Autoscale
+	// HandlePanic for jobs that fail with panic, panics are recovered and returned as *PanicError which is retried
+	// like any other error, worker keeps processing jobs with its state initialized again. Panics in Deadline,
+	// Retryable, KeyFunc or Key of a job fail the job with *PanicError without retries
 	HandlePanic bool
 	// Worker of the pool
 	Worker func(context.Context, J) (R, error)
+	// FlatMap is used instead of Worker to emit zero or more results per job. Results emitted in a failed attempt are
+	// discarded, emit must not be called after FlatMap returns
+	FlatMap func(ctx context.Context, job J, emit func(result R)) error
+	// newWorker is used instead of Worker for workers with their own state, returns worker and func closing its state
+	newWorker func(ctx context.Context, workerID int) (worker func(context.Context, J) (R, error), close func(), err error)
+	// err of a config that can not be used, returned when pool is created
+	err error
 }
 
-// DefaultConfig returns a new Config[J, R] with JobQueueLimit and ResultQueueLimit equal to 100 * size
+// DefaultConfig returns a new Config[J, R] with JobQueueLimit, ResultQueueLimit and ErrorQueueLimit equal to 100 * size
 func DefaultConfig[J, R any](Size int, Worker func(ctx context.Context, job J) (R, error)) *Config[J, R] {
 	return &Config[J, R]{
 		Size:             Size,
 		JobQueueLimit:    100 * Size,
 		ResultQueueLimit: 100 * Size,
+		ErrorQueueLimit:  100 * Size,
 		MaxRetry:         0,
 		HandlePanic:      false,
 		Worker:           Worker,
 	}
 }
 
-// NewConfig returns a new Config[J, R]
+// NewConfig returns a new Config[J, R] with ErrorQueueLimit equal to ResultQueueLimit
 func NewConfig[J, R any](Size, JobQueueLimit, ResultQueueLimit, MaxRetry int, HandlePanic bool, Worker func(ctx context.Context, job J) (R, error)) *Config[J, R] {
 	return &Config[J, R]{
 		Size:             Size,
 		JobQueueLimit:    JobQueueLimit,
 		ResultQueueLimit: ResultQueueLimit,
+		ErrorQueueLimit:  ResultQueueLimit,
 		MaxRetry:         MaxRetry,
 		HandlePanic:      HandlePanic,
 		Worker:           Worker,
 	}
 }
+
+// DefaultStatefulConfig returns a new Config[J, R] for workers with their own state S, e.g. a DB connection or HTTP
+// client, with JobQueueLimit, ResultQueueLimit and ErrorQueueLimit equal to 100 * size. Init creates state of every
+// worker once it starts, workers of a stage are numbered from 1. Worker is invoked with state of the worker processing
+// the job. Close, if not nil, is called with the state once the worker exits or retires due to Resize. With
+// HandlePanic state of a worker whose job panicked is closed and initialized again before its next attempt, the job
+// fails without retries if Init fails then. Init failure of a worker started with the pool is returned by NewPool or
+// Build
+func DefaultStatefulConfig[J, R, S any](Size int, Init func(ctx context.Context, workerID int) (S, error), Worker func(ctx context.Context, state S, job J) (R, error), Close func(state S)) *Config[J, R] {
+	config := DefaultConfig[J, R](Size, nil)
+	if Init == nil {
+		config.err = errors.New("expected Init of stateful worker to be not nil")
+		return config
+	}
+	if Worker == nil {
+		config.err = errors.New("expected Worker of stateful worker to be not nil")
+		return config
+	}
+	config.newWorker = func(ctx context.Context, workerID int) (func(context.Context, J) (R, error), func(), error) {
+		state, err := Init(ctx, workerID)
+		if err != nil {
+			return nil, nil, err
+		}
+		worker := func(ctx context.Context, job J) (R, error) {
+			return Worker(ctx, state, job)
+		}
+		return worker, func() {
+			if Close != nil {
+				Close(state)
+			}
+		}, nil
+	}
+	return config
+}
+
+// DefaultFlatMapConfig returns a new Config[J, R] for a stage that emits zero or more results per job, with
+// JobQueueLimit, ResultQueueLimit and ErrorQueueLimit equal to 100 * size
+func DefaultFlatMapConfig[J, R any](Size int, FlatMap func(ctx context.Context, job J, emit func(result R)) error) *Config[J, R] {
+	config := DefaultConfig[J, R](Size, nil)
+	config.FlatMap = FlatMap
+	return config
+}
+
+// DefaultFilterConfig returns a new Config[J, J] for a stage that passes only jobs for which Filter returns true,
+// with JobQueueLimit, ResultQueueLimit and ErrorQueueLimit equal to 100 * size
+func DefaultFilterConfig[J any](Size int, Filter func(ctx context.Context, job J) (bool, error)) *Config[J, J] {
+	return DefaultFlatMapConfig(Size, func(ctx context.Context, job J, emit func(result J)) error {
+		ok, err := Filter(ctx, job)
+		if ok && err == nil {
+			emit(job)
+		}
+		return err
+	})
+}
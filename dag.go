@@ -0,0 +1,240 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DAGJob is a job of DAG task passed to the worker of its pool
+type DAGJob[J, R any] struct {
+	// ID of the task
+	ID  string
+	Job J
+	// Deps are results of tasks it depends on by their ID
+	Deps map[string]R
+}
+
+// state of a DAG task
+type taskState int
+
+const (
+	// taskMissing is a task others depend on that is not submitted yet
+	taskMissing taskState = iota
+	taskWaiting
+	taskRunning
+	taskSucceeded
+	taskFailed
+)
+
+type task[J any] struct {
+	id        string
+	job       J
+	state     taskState
+	dependsOn []string
+	// err of failed task
+	err error
+	// waiting is number of dependencies that have not succeeded yet
+	waiting    int
+	dependents []*task[J]
+}
+
+// DAG executes tasks on a pool once tasks they depend on succeed. A task is skipped with DependencyError if any of
+// its dependencies fail
+//
+//	d, err := pool.NewDAG(ctx, pool.DefaultConfig(4, func(ctx context.Context, job pool.DAGJob[Step, Artifact]) (Artifact, error) {...}))
+//	d.Submit("compile", compile)
+//	d.Submit("test", test, "compile")
+//	results, errs := d.Wait()
+type DAG[J, R any] struct {
+	pool    Pool[DAGJob[J, R], R]
+	ctx     context.Context
+	mutex   sync.Mutex
+	tasks   map[string]*task[J]
+	results map[string]R
+	errors  []JobError
+	// pending tasks that have not succeeded or failed yet
+	pending sync.WaitGroup
+	closed  bool
+}
+
+// NewDAG creates new DAG executing tasks with a pool of config
+func NewDAG[J, R any](ctx context.Context, config *Config[DAGJob[J, R], R]) (*DAG[J, R], error) {
+	p, err := NewPool(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return &DAG[J, R]{
+		pool:    p,
+		ctx:     ctx,
+		tasks:   map[string]*task[J]{},
+		results: map[string]R{},
+	}, nil
+}
+
+// Submit task with id that runs once tasks of dependsOn succeed, tasks it depends on may be submitted later.
+// Returns ErrCycle if task would create a dependency cycle and ErrPoolClosed after Wait. It blocks while job que
+// of the pool is full if task is ready to run
+func (d *DAG[J, R]) Submit(id string, job J, dependsOn ...string) error {
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		return ErrPoolClosed
+	}
+	t := d.tasks[id]
+	if t != nil && t.state != taskMissing {
+		d.mutex.Unlock()
+		return fmt.Errorf("task %s already submitted", id)
+	}
+	if d.cyclic(id, dependsOn) {
+		d.mutex.Unlock()
+		return fmt.Errorf("%w: task %s", ErrCycle, id)
+	}
+	if t == nil {
+		t = &task[J]{id: id}
+		d.tasks[id] = t
+	}
+	t.job = job
+	t.state = taskWaiting
+	t.dependsOn = dependsOn
+	d.pending.Add(1)
+	var failed *task[J]
+	for _, dep := range dependsOn {
+		dependency := d.tasks[dep]
+		if dependency == nil {
+			dependency = &task[J]{id: dep}
+			d.tasks[dep] = dependency
+		}
+		switch dependency.state {
+		case taskSucceeded:
+		case taskFailed:
+			failed = dependency
+		default:
+			t.waiting++
+			dependency.dependents = append(dependency.dependents, t)
+		}
+	}
+	var ready []*task[J]
+	if failed != nil {
+		d.skip(t, failed.id, failed.err)
+	} else if t.waiting == 0 {
+		t.state = taskRunning
+		ready = append(ready, t)
+	}
+	d.mutex.Unlock()
+	d.start(ready)
+	return nil
+}
+
+// cyclic reports if task id depending on dependsOn creates a cycle, mutex must be held
+func (d *DAG[J, R]) cyclic(id string, dependsOn []string) bool {
+	visited := map[string]bool{}
+	stack := append([]string(nil), dependsOn...)
+	for len(stack) > 0 {
+		next := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if next == id {
+			return true
+		}
+		if visited[next] {
+			continue
+		}
+		visited[next] = true
+		if t := d.tasks[next]; t != nil && t.state == taskWaiting {
+			stack = append(stack, t.dependsOn...)
+		}
+	}
+	return false
+}
+
+// start ready tasks on the pool
+func (d *DAG[J, R]) start(ready []*task[J]) {
+	for _, t := range ready {
+		d.mutex.Lock()
+		deps := make(map[string]R, len(t.dependsOn))
+		for _, dep := range t.dependsOn {
+			deps[dep] = d.results[dep]
+		}
+		d.mutex.Unlock()
+		future, err := d.pool.Submit(d.ctx, DAGJob[J, R]{ID: t.id, Job: t.job, Deps: deps})
+		if err != nil {
+			d.complete(t, *new(R), err)
+			continue
+		}
+		go func(t *task[J]) {
+			result, err := future.Wait(context.Background())
+			d.complete(t, result, err)
+		}(t)
+	}
+}
+
+// complete task with its result or error, starts dependents that are ready or skips them if task failed
+func (d *DAG[J, R]) complete(t *task[J], result R, err error) {
+	d.mutex.Lock()
+	var ready []*task[J]
+	if err != nil {
+		var jobErr JobError
+		if !errors.As(err, &jobErr) {
+			jobErr = JobError{Job: t.job, Err: err}
+		}
+		t.state = taskFailed
+		t.err = err
+		d.errors = append(d.errors, jobErr)
+		for _, dependent := range t.dependents {
+			d.skip(dependent, t.id, err)
+		}
+	} else {
+		t.state = taskSucceeded
+		d.results[t.id] = result
+		for _, dependent := range t.dependents {
+			if dependent.waiting--; dependent.waiting == 0 && dependent.state == taskWaiting {
+				dependent.state = taskRunning
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	t.dependents = nil
+	d.pending.Done()
+	d.mutex.Unlock()
+	d.start(ready)
+}
+
+// skip task and its dependents as dependency failed with err, mutex must be held
+func (d *DAG[J, R]) skip(t *task[J], dependency string, err error) {
+	if t.state != taskWaiting {
+		return
+	}
+	t.state = taskFailed
+	t.err = &DependencyError{ID: t.id, Dependency: dependency, Err: err}
+	d.errors = append(d.errors, JobError{Job: t.job, Err: t.err})
+	for _, dependent := range t.dependents {
+		d.skip(dependent, t.id, t.err)
+	}
+	t.dependents = nil
+	d.pending.Done()
+}
+
+// Wait closes DAG for new tasks, tasks depending on tasks that were never submitted are skipped with
+// ErrMissingDependency. Returns results of succeeded tasks by ID and errors of failed and skipped tasks once all
+// tasks are complete
+func (d *DAG[J, R]) Wait() (map[string]R, []JobError) {
+	d.mutex.Lock()
+	d.closed = true
+	for id, t := range d.tasks {
+		if t.state != taskMissing {
+			continue
+		}
+		for _, dependent := range t.dependents {
+			d.skip(dependent, id, ErrMissingDependency)
+		}
+		t.dependents = nil
+	}
+	d.mutex.Unlock()
+	d.pending.Wait()
+	for range d.pool.Close() {
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.results, append(d.errors, d.pool.Errors()...)
+}
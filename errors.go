@@ -0,0 +1,238 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// ErrPoolClosed is returned when jobs are submitted after pool is closed
+var ErrPoolClosed = errors.New("pool is closed")
+
+// ErrShutdown is error of jobs cancelled by Pool.Shutdown once its context is done, wraps context.Canceled
+var ErrShutdown = fmt.Errorf("pool shut down: %w", context.Canceled)
+
+// ErrFiltered resolves future of a submitted job that was filtered out by a stage without results
+var ErrFiltered = errors.New("job filtered out")
+
+// ErrBatched resolves future of a submitted job that was grouped in a batch carrying JobID of another job
+var ErrBatched = errors.New("job batched with another job")
+
+// ErrNoRoute is error of a job for which Router returned index of a branch that does not exist
+var ErrNoRoute = errors.New("no route for job")
+
+// ErrCycle is returned when a task submitted to DAG would create a dependency cycle
+var ErrCycle = errors.New("dependency cycle")
+
+// ErrDependencyFailed is error of a DAG task skipped because a task it depends on failed
+var ErrDependencyFailed = errors.New("dependency failed")
+
+// ErrMissingDependency is error of a task DAG depends on that was never submitted
+var ErrMissingDependency = errors.New("dependency not submitted")
+
+// DependencyError of a DAG task skipped because task Dependency it depends on failed or was never submitted
+type DependencyError struct {
+	// ID of the skipped task
+	ID string
+	// Dependency that failed
+	Dependency string
+	// Err of the dependency
+	Err error
+}
+
+func (e *DependencyError) Error() string {
+	return fmt.Sprintf("dependency %s of task %s failed: %v", e.Dependency, e.ID, e.Err)
+}
+
+// Unwrap returns error of the dependency
+func (e *DependencyError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports true for ErrDependencyFailed
+func (e *DependencyError) Is(target error) bool {
+	return target == ErrDependencyFailed
+}
+
+// PanicError for a job whose worker panicked while Config.HandlePanic is set
+type PanicError struct {
+	// Value recovered from panic
+	Value any
+	// Stack trace of the panicking worker goroutine
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in worker: %v", e.Value)
+}
+
+// Unwrap returns recovered value if it is an error
+func (e *PanicError) Unwrap() error {
+	if err, ok := e.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// timeoutError wraps an error returned by a worker after its invocation deadline was exceeded
+type timeoutError struct {
+	err error
+}
+
+func (e *timeoutError) Error() string {
+	return e.err.Error()
+}
+
+func (e *timeoutError) Unwrap() error {
+	return e.err
+}
+
+func (e *timeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+// Permanent wraps err returned by a worker so that the job is not retried, returns nil if err is nil
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// RetryAfter wraps err returned by a worker so that the job is retried after given delay instead of the
+// RetryPolicy backoff, returns nil if err is nil. Attempt budget of the pool still applies
+func RetryAfter(err error, delay time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &retryAfterError{err, delay}
+}
+
+// IsPermanent reports whether any error in err's chain was wrapped with Permanent
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+// retryAfter returns delay requested with RetryAfter in err's chain
+func retryAfter(err error) (time.Duration, bool) {
+	var after *retryAfterError
+	if errors.As(err, &after) {
+		return after.delay, true
+	}
+	return 0, false
+}
+
+// errorCollector collects JobError from all stages of a pool and optionally streams them as they occur
+type errorCollector struct {
+	mutex   sync.Mutex
+	errors  []JobError
+	limit   int
+	ch      chan JobError
+	sending sync.WaitGroup
+	closed  bool
+	// resolve errors of jobs awaited separately, resolved errors are not collected
+	resolve func(JobError) bool
+}
+
+func newErrorCollector(limit int) *errorCollector {
+	return &errorCollector{limit: limit}
+}
+
+// add jobErr to collected errors and stream it if channel was requested, blocks until it is received or ctx is done
+func (c *errorCollector) add(ctx context.Context, jobErr JobError) {
+	if c.resolve != nil && c.resolve(jobErr) {
+		return
+	}
+	c.mutex.Lock()
+	c.errors = append(c.errors, jobErr)
+	if c.ch == nil || c.closed {
+		c.mutex.Unlock()
+		return
+	}
+	ch := c.ch
+	c.sending.Add(1)
+	c.mutex.Unlock()
+	defer c.sending.Done()
+	select {
+	case ch <- jobErr:
+		return
+	default:
+	}
+	select {
+	case ch <- jobErr:
+	case <-ctx.Done():
+	}
+}
+
+// resolveOnly jobErr of a job awaited separately, it is never collected
+func (c *errorCollector) resolveOnly(jobErr JobError) {
+	if c.resolve != nil {
+		c.resolve(jobErr)
+	}
+}
+
+// list returns copy of collected errors
+func (c *errorCollector) list() []JobError {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]JobError(nil), c.errors...)
+}
+
+// channel returns errors stream, errors collected before first call are buffered in addition to limit
+func (c *errorCollector) channel() <-chan JobError {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.ch == nil {
+		c.ch = make(chan JobError, c.limit+len(c.errors))
+		for _, jobErr := range c.errors {
+			c.ch <- jobErr
+		}
+		if c.closed {
+			close(c.ch)
+		}
+	}
+	return c.ch
+}
+
+// close errors stream, errors added afterwards are only collected
+func (c *errorCollector) close() {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return
+	}
+	c.closed = true
+	c.mutex.Unlock()
+	c.sending.Wait()
+	if c.ch != nil {
+		close(c.ch)
+	}
+}
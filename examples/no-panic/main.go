@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"time"
@@ -26,7 +27,7 @@ func main() {
 	// set context for workers
 	ctx := context.WithValue(context.Background(), customKey1{}, "first-value")
 	ctx = context.WithValue(ctx, customKey2{}, 2)
-	// create a retry able pool with Job and Result type, maxRetry set to 10
+	// create a retry able pool with Job and Result type, maxRetry set to 20, panics are retried as errors
 	p, err := pool.NewPool(ctx, pool.NewConfig(5, 100, 100, 20, true, worker))
 	for i := 0; i < 20; i++ {
 		// send a job to pool
@@ -39,6 +40,13 @@ func main() {
 	for result := range p.Close() {
 		fmt.Println(result.str, "in", result.dur)
 	}
+	// jobs that still panicked after retries are reported with *pool.PanicError
+	for _, jobErr := range p.Errors() {
+		var panicErr *pool.PanicError
+		if errors.As(jobErr, &panicErr) {
+			fmt.Println(jobErr.Job.(Job).str, "panicked with", panicErr.Value)
+		}
+	}
 }
 
 // worker with job type Job struct and result type Result
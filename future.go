@@ -0,0 +1,59 @@
+package pool
+
+import (
+	"context"
+	"sync"
+)
+
+// Future of a job submitted with Pool.Submit
+type Future[R any] struct {
+	id     uint64
+	done   chan struct{}
+	once   sync.Once
+	result R
+	err    error
+	cancel context.CancelFunc
+}
+
+func newFuture[R any](cancel context.CancelFunc) *Future[R] {
+	return &Future[R]{
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+}
+
+// ID of the submitted job, same as JobError.JobID
+func (f *Future[R]) ID() uint64 {
+	return f.id
+}
+
+// Wait for result of the job or ctx to be done. Error is JobError if job failed in any of the stages
+func (f *Future[R]) Wait(ctx context.Context) (R, error) {
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		var result R
+		return result, ctx.Err()
+	}
+}
+
+// Done is closed once result or error of the job is available
+func (f *Future[R]) Done() <-chan struct{} {
+	return f.done
+}
+
+// Cancel the job, cancels context passed to worker processing it and resolves future with context.Canceled
+func (f *Future[R]) Cancel() {
+	var result R
+	f.resolve(result, context.Canceled)
+}
+
+func (f *Future[R]) resolve(result R, err error) {
+	f.once.Do(func() {
+		f.result = result
+		f.err = err
+		close(f.done)
+		f.cancel()
+	})
+}
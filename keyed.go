@@ -0,0 +1,206 @@
+package pool
+
+import (
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// Keyed can be implemented by job type to set its key, e.g. a customer or tenant, in stages with
+// Config.SerializeByKey or Config.FairByKey
+type Keyed interface {
+	Key() string
+}
+
+// keyQueue of jobs with same key in scheduler
+type keyQueue[J any] struct {
+	jobs []item[J]
+	// active jobs of key being processed by workers
+	active int
+	// credit left in current turn of key
+	credit int
+	// scheduled is true while key is in round of scheduler
+	scheduled bool
+}
+
+// scheduler of jobs by key, jobs of a key are started in order they were sent with deficit round-robin between
+// keys. Every key gets up to its weight jobs per turn
+type scheduler[J any] struct {
+	queues map[string]*keyQueue[J]
+	// round of keys with queued jobs that can be started
+	round []string
+	// maxActive jobs per key, 0 means no limit
+	maxActive int
+	weight    func(key string) int
+	// queued jobs across keys
+	queued int
+}
+
+// push job with key
+func (s *scheduler[J]) push(key string, job item[J]) {
+	q := s.queues[key]
+	if q == nil {
+		q = &keyQueue[J]{}
+		s.queues[key] = q
+	}
+	q.jobs = append(q.jobs, job)
+	s.queued++
+	s.schedule(key, q)
+}
+
+// release key of a processed job
+func (s *scheduler[J]) release(key string) {
+	q := s.queues[key]
+	q.active--
+	if q.active == 0 && len(q.jobs) == 0 && !q.scheduled {
+		delete(s.queues, key)
+		return
+	}
+	s.schedule(key, q)
+}
+
+// schedule key in round if it has jobs that can be started
+func (s *scheduler[J]) schedule(key string, q *keyQueue[J]) {
+	if !q.scheduled && len(q.jobs) > 0 && (s.maxActive == 0 || q.active < s.maxActive) {
+		q.scheduled = true
+		s.round = append(s.round, key)
+	}
+}
+
+// next job to start, false if no job can be started
+func (s *scheduler[J]) next() (string, item[J], bool) {
+	for len(s.round) > 0 {
+		key := s.round[0]
+		q := s.queues[key]
+		if len(q.jobs) == 0 || (s.maxActive > 0 && q.active >= s.maxActive) {
+			// key is scheduled again once it has jobs that can be started
+			s.round = s.round[1:]
+			q.scheduled = false
+			q.credit = 0
+			if q.active == 0 && len(q.jobs) == 0 {
+				// key left in round after its last job was released
+				delete(s.queues, key)
+			}
+			continue
+		}
+		if q.credit == 0 {
+			q.credit = 1
+			if s.weight != nil && s.weight(key) > 1 {
+				q.credit = s.weight(key)
+			}
+		}
+		job := q.jobs[0]
+		q.jobs[0] = item[J]{}
+		q.jobs = q.jobs[1:]
+		q.active++
+		q.credit--
+		s.queued--
+		if q.credit == 0 {
+			// turn of key is over
+			s.round = append(s.round[1:], key)
+		}
+		return key, job, true
+	}
+	return "", item[J]{}, false
+}
+
+// key of job from KeyFunc or Keyed, jobs without key share empty key. Panic is returned as *PanicError with
+// HandlePanic
+func (p *singleStagePool[J, R]) key(job J) (key string, err error) {
+	if p.HandlePanic {
+		defer func() {
+			if r := recover(); r != nil {
+				err = &PanicError{Value: r, Stack: debug.Stack()}
+			}
+		}()
+	}
+	if p.KeyFunc != nil {
+		return p.KeyFunc(job), nil
+	}
+	if keyed, ok := any(job).(Keyed); ok {
+		return keyed.Key(), nil
+	}
+	return "", nil
+}
+
+// scheduled reports if jobs of stage are scheduled by key
+func (p *singleStagePool[J, R]) scheduled() bool {
+	return p.SerializeByKey || p.FairByKey
+}
+
+// schedule jobs from in by key, returns channel of jobs that can be started by workers. Workers send key of a
+// processed job to released. Up to limit jobs are queued besides jobs in in
+func (p *singleStagePool[J, R]) schedule(in <-chan item[J], limit int) <-chan item[J] {
+	out := make(chan item[J])
+	p.released = make(chan string)
+	s := &scheduler[J]{
+		queues:    map[string]*keyQueue[J]{},
+		maxActive: p.MaxPerKey,
+		weight:    p.KeyWeight,
+	}
+	if p.SerializeByKey {
+		s.maxActive = 1
+	}
+	p.spawn(func() {
+		defer close(out)
+		var (
+			// skips pass through in ordered pools
+			skips  []item[J]
+			head   item[J]
+			ready  bool
+			closed bool
+		)
+		for {
+			if !ready {
+				if len(skips) > 0 {
+					head, skips, ready = skips[0], skips[1:], true
+				} else {
+					_, head, ready = s.next()
+				}
+			}
+			backlog := s.queued + len(skips)
+			if ready {
+				backlog++
+			}
+			atomic.StoreInt64(&p.backlog, int64(backlog))
+			var (
+				jobs <-chan item[J]
+				next chan<- item[J]
+			)
+			if !closed && s.queued+len(skips) < limit {
+				jobs = in
+			}
+			if ready {
+				next = out
+			}
+			if jobs == nil && next == nil && len(s.queues) == 0 {
+				return
+			}
+			select {
+			case job, ok := <-jobs:
+				if !ok {
+					closed = true
+					continue
+				}
+				if job.skip {
+					skips = append(skips, job)
+					continue
+				}
+				key, err := p.key(job.value)
+				if err != nil {
+					// job is passed on as skip for workers to release its slot in job que and its interval
+					p.addError(job.id, JobError{Job: job.value, Err: err})
+					job.skip = true
+					skips = append(skips, job)
+					continue
+				}
+				job.key = key
+				s.push(key, job)
+			case next <- head:
+				head, ready = item[J]{}, false
+			case key := <-p.released:
+				s.release(key)
+			}
+		}
+	})
+	return out
+}
@@ -0,0 +1,752 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fullWeight of a job in ordered pools, it is split between items the job results in across stages
+const fullWeight uint64 = 1 << 63
+
+// errQueueFull is returned by enqueue when job can not be sent without blocking
+var errQueueFull = errors.New("job que is full")
+
+// item passed between stages, carries id of the job submitted to the first stage it originates from
+type item[T any] struct {
+	id    uint64
+	value T
+	// ctx of submitted job, nil for jobs sent with SendJobs
+	ctx context.Context
+	// offset and weight of the interval of job carried by item in ordered pools. A job starts with interval
+	// [0, fullWeight) which is split between its results in every stage, results are sent in order of offset
+	offset, weight uint64
+	// skip item carries only interval of a job that failed or had no results in ordered pools
+	skip bool
+	// parts of jobs batched into item in ordered pools, item itself carries interval of the first part
+	parts []part
+	// priority of job in first stage of pools with Config.Priority
+	priority int
+	// key of job in stages scheduling jobs by key, released by worker once job is processed
+	key string
+}
+
+// part of a job batched into an item
+type part struct {
+	id             uint64
+	ctx            context.Context
+	offset, weight uint64
+}
+
+// split interval of item between n items, the last item gets the remainder
+func (i item[T]) split(n, index int) (offset, weight uint64) {
+	share := i.weight / uint64(n)
+	offset = i.offset + share*uint64(index)
+	if index == n-1 {
+		return offset, i.weight - share*uint64(n-1)
+	}
+	return offset, share
+}
+
+// batched returns parts of jobs batched into item other than the first
+func (i item[T]) batched() []part {
+	if len(i.parts) <= 1 {
+		return nil
+	}
+	return i.parts[1:]
+}
+
+// skipped returns skip item for the part
+func skipped[T any](p part) item[T] {
+	return item[T]{id: p.id, ctx: p.ctx, offset: p.offset, weight: p.weight, skip: true}
+}
+
+// run of a pool shared by all its stages
+type run struct {
+	ctx    *shutdownContext
+	errors *errorCollector
+	// ordered is true if stages pass on intervals and skip items of jobs, for ordering results or for resolving
+	// futures of teed jobs once all copies are accounted for
+	ordered bool
+	// offset added to stage numbers of a branch
+	offset int
+	// stages with workers by stage number
+	stages map[int]stageControl
+	// goroutines of all stages
+	goroutines *sync.WaitGroup
+	// init of workers started with the pool
+	init *workerInit
+	// slots of job que of first stage when jobs are queued by priority or key instead of in jobs channel, taken by
+	// senders and released once a worker of first stage takes the job. nil if jobs are queued in jobs channel
+	slots chan struct{}
+}
+
+// spawn goroutine of a stage
+func (r *run) spawn(f func()) {
+	r.goroutines.Add(1)
+	go func() {
+		defer r.goroutines.Done()
+		f()
+	}()
+}
+
+// shutdownContext of a pool, its Err returns ErrShutdown once it is canceled by Shutdown
+type shutdownContext struct {
+	context.Context
+	// parent context the pool was created with
+	parent context.Context
+	cancel context.CancelFunc
+	forced int32
+}
+
+func newShutdownContext(parent context.Context) *shutdownContext {
+	ctx, cancel := context.WithCancel(parent)
+	return &shutdownContext{Context: ctx, parent: parent, cancel: cancel}
+}
+
+func (c *shutdownContext) Err() error {
+	err := c.Context.Err()
+	if err != nil && atomic.LoadInt32(&c.forced) == 1 {
+		return ErrShutdown
+	}
+	return err
+}
+
+// force cancels context unless parent context is already done
+func (c *shutdownContext) force() {
+	if c.parent.Err() == nil {
+		atomic.StoreInt32(&c.forced, 1)
+	}
+	c.cancel()
+}
+
+// stageControl of a stage with workers
+type stageControl interface {
+	resize(n int) error
+	pause(paused bool) error
+	stats() StageStats
+}
+
+// stage number of stage in pool
+func (r *run) stage(stage int) int {
+	return r.offset + stage
+}
+
+// pendingJob in reorder buffer of ordered pool
+type pendingJob[R any] struct {
+	// results by offset including skip items
+	results map[uint64]item[R]
+	// next offset to send results from
+	next uint64
+}
+
+// pipeline of one or more chained stages, it owns jobs channel of the first stage and forwards results of the
+// last stage to results channel returned by Close
+type pipeline[J, R any] struct {
+	// nextID is first for 64-bit alignment required by atomic
+	nextID uint64
+	*run
+	jobs    chan item[J]
+	results chan R
+	// names of stages, used for errors recorded by pipeline
+	names []string
+	// done is closed after results channel is closed and errors are collected
+	done chan struct{}
+	// sendMutex guards jobs channel against being closed while SendJobs is sending, it is locked for writing only by
+	// closeJobs once closing is closed so senders never wait for it
+	sendMutex sync.RWMutex
+	closed    bool
+	// closing is closed by Close or Shutdown to return senders blocked on job que so jobs channel can be closed
+	closing     chan struct{}
+	closingOnce sync.Once
+	// futures of submitted jobs by id, failures of submitted jobs are held until all results of the job are
+	// accounted for in pools passing on intervals
+	futures      map[uint64]*Future[R]
+	failures     map[uint64]JobError
+	futuresMutex sync.Mutex
+	// covered weight of interval of submitted jobs by id, only accessed by goroutine forwarding results
+	covered map[uint64]uint64
+	// window limits jobs in flight of ordered pool, nil if pool is not ordered
+	window chan struct{}
+	// orderMutex keeps ids of jobs in ordered pool consecutive
+	orderMutex sync.Mutex
+	// pending jobs in reorder buffer by id, nextOut is id of job results are sent for next
+	pending map[uint64]*pendingJob[R]
+	nextOut uint64
+}
+
+// newPipeline creates pipeline, results are sent in order of jobs if orderWindow is more than 0
+func newPipeline[J, R any](ctx context.Context, jobQueueLimit, resultQueueLimit, errorQueueLimit, orderWindow int, names ...string) *pipeline[J, R] {
+	p := &pipeline[J, R]{
+		run: &run{
+			ctx:        newShutdownContext(ctx),
+			errors:     newErrorCollector(errorQueueLimit),
+			ordered:    orderWindow > 0,
+			stages:     map[int]stageControl{},
+			goroutines: &sync.WaitGroup{},
+			init:       newWorkerInit(0),
+		},
+		jobs:     make(chan item[J], jobQueueLimit),
+		results:  make(chan R, resultQueueLimit),
+		names:    names,
+		done:     make(chan struct{}),
+		closing:  make(chan struct{}),
+		futures:  map[uint64]*Future[R]{},
+		failures: map[uint64]JobError{},
+		covered:  map[uint64]uint64{},
+	}
+	if p.ordered {
+		p.window = make(chan struct{}, orderWindow)
+		p.pending = map[uint64]*pendingJob[R]{}
+		p.nextOut = 1
+	}
+	p.errors.resolve = p.resolveError
+	return p
+}
+
+// start forwarding results of the last stage, closes jobs channel once ctx is done
+func (p *pipeline[J, R]) start(results <-chan item[R]) {
+	p.spawn(func() {
+		for result := range results {
+			p.forward(result)
+			// parts of a batch from last stage are accounted for along with it
+			for _, part := range result.batched() {
+				p.forward(skipped[R](part))
+			}
+		}
+		p.flush()
+		// jobs whose results were lost due to cancellation
+		p.futuresMutex.Lock()
+		failed := make([]uint64, 0, len(p.failures))
+		for id := range p.failures {
+			failed = append(failed, id)
+		}
+		p.futuresMutex.Unlock()
+		for _, id := range failed {
+			p.settle(id)
+		}
+		close(p.results)
+		p.errors.close()
+		close(p.done)
+		// release resources of context once all stages are done
+		p.ctx.cancel()
+	})
+	p.spawn(func() {
+		select {
+		case <-p.ctx.Done():
+			// workers record queued jobs as JobError with ctx.Err() and exit
+			p.closeJobs()
+		case <-p.done:
+		}
+	})
+}
+
+// forward result of last stage in order of jobs if pool is ordered, then account for its interval
+func (p *pipeline[J, R]) forward(result item[R]) {
+	if p.window != nil {
+		p.reorder(result)
+	} else {
+		p.sendResult(result)
+	}
+	p.cover(result)
+}
+
+// cover interval of submitted job with result in pools passing on intervals, failure of the job is settled once
+// its interval is covered
+func (p *pipeline[J, R]) cover(result item[R]) {
+	if !p.ordered || result.ctx == nil {
+		return
+	}
+	covered := p.covered[result.id] + result.weight
+	if covered < fullWeight {
+		p.covered[result.id] = covered
+		return
+	}
+	p.settle(result.id)
+}
+
+// settle submitted job once all its results are accounted for, its future is resolved with first failure of the job
+// if it was not resolved with a result. Failures other than ErrFiltered are preferred
+func (p *pipeline[J, R]) settle(id uint64) {
+	delete(p.covered, id)
+	p.futuresMutex.Lock()
+	failure, failed := p.failures[id]
+	delete(p.failures, id)
+	future := p.futures[id]
+	if failed {
+		delete(p.futures, id)
+	}
+	p.futuresMutex.Unlock()
+	if failed && future != nil {
+		var result R
+		future.resolve(result, failure)
+	}
+}
+
+// sendResult to results channel or future of the job, result is recorded as JobError if context is done before
+// it can be sent
+func (p *pipeline[J, R]) sendResult(result item[R]) {
+	if result.skip {
+		return
+	}
+	if future := p.takeFuture(result.id); future != nil {
+		future.resolve(result.value, nil)
+		return
+	}
+	if result.ctx != nil {
+		// future of submitted job is resolved with its first result
+		return
+	}
+	if !send(p.ctx, p.results, result.value) {
+		p.addError(len(p.names), JobError{Job: result.value, JobID: result.id, Err: p.ctx.Err()})
+	}
+}
+
+// reorder result of ordered pool, results of a job are sent in order of offset once all jobs sent before it are
+// complete. Futures are resolved right away as they do not depend on order
+func (p *pipeline[J, R]) reorder(result item[R]) {
+	if !result.skip {
+		if future := p.takeFuture(result.id); future != nil {
+			future.resolve(result.value, nil)
+			result.skip = true
+		}
+	}
+	job := p.pending[result.id]
+	if job == nil {
+		job = &pendingJob[R]{results: map[uint64]item[R]{}}
+		p.pending[result.id] = job
+	}
+	job.results[result.offset] = result
+	for job = p.pending[p.nextOut]; job != nil; job = p.pending[p.nextOut] {
+		for next, ok := job.results[job.next]; ok; next, ok = job.results[job.next] {
+			delete(job.results, job.next)
+			p.sendResult(next)
+			job.next += next.weight
+		}
+		if job.next < fullWeight {
+			return
+		}
+		delete(p.pending, p.nextOut)
+		p.nextOut++
+		<-p.window
+	}
+}
+
+// flush results left in reorder buffer in order of jobs, jobs before them did not complete due to cancellation
+func (p *pipeline[J, R]) flush() {
+	ids := make([]uint64, 0, len(p.pending))
+	for id := range p.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	for _, id := range ids {
+		results := make([]item[R], 0, len(p.pending[id].results))
+		for _, result := range p.pending[id].results {
+			results = append(results, result)
+		}
+		sort.Slice(results, func(i, j int) bool {
+			return results[i].offset < results[j].offset
+		})
+		for _, result := range results {
+			p.sendResult(result)
+		}
+		delete(p.pending, id)
+	}
+}
+
+func (p *pipeline[J, R]) addError(stage int, jobErr JobError) {
+	jobErr.Stage = stage
+	jobErr.StageName = p.names[stage-1]
+	jobErr.Failed = time.Now()
+	p.errors.add(p.ctx, jobErr)
+}
+
+func (p *pipeline[J, R]) closeJobs() {
+	p.closingOnce.Do(func() {
+		close(p.closing)
+	})
+	p.sendMutex.Lock()
+	defer p.sendMutex.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+}
+
+// SendJobs to job que for first stage, jobs that can not be sent because pool is closed or its context is done are
+// recorded as JobError
+func (p *pipeline[J, R]) SendJobs(jobs ...J) {
+	p.sendJobs(jobs, prioritized[J])
+}
+
+// SendJobsPriority to job que for first stage with priority, see SendJobs
+func (p *pipeline[J, R]) SendJobsPriority(priority int, jobs ...J) {
+	p.sendJobs(jobs, func(J) int {
+		return priority
+	})
+}
+
+func (p *pipeline[J, R]) sendJobs(jobs []J, priority func(J) int) {
+	unsent, err := p.send(context.Background(), jobs, priority)
+	for _, job := range unsent {
+		p.addError(1, JobError{Job: job, JobID: p.newID(), Err: err})
+	}
+}
+
+// SendJobsContext to job que for first stage, returns ErrPoolClosed if pool is closed or ctx.Err() if ctx or pool
+// context is done before all jobs are sent
+func (p *pipeline[J, R]) SendJobsContext(ctx context.Context, jobs ...J) error {
+	_, err := p.send(ctx, jobs, prioritized[J])
+	return err
+}
+
+// TrySend job to job que for first stage without blocking, returns false if job que is full or pool is closed
+func (p *pipeline[J, R]) TrySend(job J) bool {
+	if p.lockSend() != nil {
+		return false
+	}
+	defer p.sendMutex.RUnlock()
+	if p.ctx.Err() != nil {
+		return false
+	}
+	return p.enqueue(context.Background(), item[J]{value: job, priority: prioritized(job)}, nil, false) == nil
+}
+
+// send jobs to job que with priority of every job, returns jobs that could not be sent with the reason
+func (p *pipeline[J, R]) send(ctx context.Context, jobs []J, priority func(J) int) ([]J, error) {
+	if err := p.lockSend(); err != nil {
+		return jobs, err
+	}
+	defer p.sendMutex.RUnlock()
+	for index, job := range jobs {
+		err := p.closedErr()
+		if err == nil {
+			if err = p.enqueue(ctx, item[J]{value: job, priority: priority(job)}, nil, true); err == nil {
+				continue
+			}
+		}
+		return jobs[index:], p.sendErr(err)
+	}
+	return nil, nil
+}
+
+// lockSend takes read lock of sendMutex without waiting for closeJobs, returns error if jobs channel is closed or
+// being closed in which case lock is not taken
+func (p *pipeline[J, R]) lockSend() error {
+	if !p.sendMutex.TryRLock() {
+		// only closeJobs locks for writing, after closing is closed
+		return p.closedErr()
+	}
+	if err := p.closedErr(); err != nil {
+		p.sendMutex.RUnlock()
+		return err
+	}
+	return nil
+}
+
+// sendErr returns error of a job that could not be sent, ErrPoolClosed of a sender returned by closing is replaced
+// by error of pool context if it is done
+func (p *pipeline[J, R]) sendErr(err error) error {
+	if err == ErrPoolClosed {
+		return p.closedErr()
+	}
+	return err
+}
+
+// enqueue next to job que with id of next job, future is registered for the id if not nil. If wait is false it
+// returns errQueueFull instead of blocking, otherwise blocks until ctx or pool context is done. In ordered pool it
+// also waits for space in order window. sendMutex must be held
+func (p *pipeline[J, R]) enqueue(ctx context.Context, next item[J], future *Future[R], wait bool) error {
+	if p.window != nil {
+		if wait {
+			p.orderMutex.Lock()
+		} else if !p.orderMutex.TryLock() {
+			return errQueueFull
+		}
+		defer p.orderMutex.Unlock()
+		if err := push(ctx, p.ctx, p.closing, p.window, struct{}{}, wait); err != nil {
+			return err
+		}
+		// id is taken only once job is sent to keep ids of ordered pool without gaps
+		next.id = atomic.LoadUint64(&p.nextID) + 1
+	} else {
+		next.id = atomic.AddUint64(&p.nextID, 1)
+	}
+	if p.ordered {
+		next.weight = fullWeight
+	}
+	if p.slots != nil {
+		if err := push(ctx, p.ctx, p.closing, p.slots, struct{}{}, wait); err != nil {
+			if p.window != nil {
+				<-p.window
+			}
+			return err
+		}
+		// job with a slot is taken right away by priority queue or scheduler
+		wait = true
+	}
+	if future != nil {
+		future.id = next.id
+		p.futuresMutex.Lock()
+		p.futures[future.id] = future
+		p.futuresMutex.Unlock()
+	}
+	err := push(ctx, p.ctx, p.closing, p.jobs, next, wait)
+	if err != nil && p.slots != nil {
+		<-p.slots
+	}
+	if p.window != nil {
+		if err == nil {
+			atomic.StoreUint64(&p.nextID, next.id)
+		} else {
+			<-p.window
+		}
+	}
+	if err != nil && future != nil {
+		p.takeFuture(future.id)
+	}
+	return err
+}
+
+// prioritized returns priority of job implementing Prioritized, 0 otherwise
+func prioritized[J any](job J) int {
+	if p, ok := any(job).(Prioritized); ok {
+		return p.Priority()
+	}
+	return 0
+}
+
+// newID for a job that could not be sent
+func (p *pipeline[J, R]) newID() uint64 {
+	if p.window == nil {
+		return atomic.AddUint64(&p.nextID, 1)
+	}
+	p.orderMutex.Lock()
+	defer p.orderMutex.Unlock()
+	id := atomic.LoadUint64(&p.nextID) + 1
+	atomic.StoreUint64(&p.nextID, id)
+	return id
+}
+
+// push value to ch, if wait is false returns errQueueFull instead of blocking, otherwise blocks until ctx or
+// poolCtx is done or closing is closed
+func push[T any](ctx, poolCtx context.Context, closing <-chan struct{}, ch chan<- T, value T, wait bool) error {
+	if !wait {
+		select {
+		case ch <- value:
+			return nil
+		default:
+			return errQueueFull
+		}
+	}
+	select {
+	case ch <- value:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-poolCtx.Done():
+		return poolCtx.Err()
+	case <-closing:
+		return ErrPoolClosed
+	}
+}
+
+// closedErr returns error for jobs sent after jobs channel is closed or being closed
+func (p *pipeline[J, R]) closedErr() error {
+	if !p.isClosing() {
+		return nil
+	}
+	if err := p.ctx.parent.Err(); err != nil {
+		return err
+	}
+	return ErrPoolClosed
+}
+
+// isClosing returns true once Close or Shutdown is called or pool context is done
+func (p *pipeline[J, R]) isClosing() bool {
+	select {
+	case <-p.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Submit job to job que for first stage and return its future, result or error of the job is delivered only to
+// the future. ctx bounds waiting for space in job que
+func (p *pipeline[J, R]) Submit(ctx context.Context, job J) (*Future[R], error) {
+	if err := p.lockSend(); err != nil {
+		return nil, err
+	}
+	defer p.sendMutex.RUnlock()
+	jobCtx, cancel := context.WithCancel(p.ctx)
+	future := newFuture[R](cancel)
+	if err := p.enqueue(ctx, item[J]{value: job, ctx: jobCtx, priority: prioritized(job)}, future, true); err != nil {
+		cancel()
+		return nil, p.sendErr(err)
+	}
+	return future, nil
+}
+
+// takeFuture removes and returns future of job id, nil if job was not submitted with Submit
+func (p *pipeline[J, R]) takeFuture(id uint64) *Future[R] {
+	p.futuresMutex.Lock()
+	defer p.futuresMutex.Unlock()
+	future, ok := p.futures[id]
+	if ok {
+		delete(p.futures, id)
+	}
+	return future
+}
+
+// resolveError of a submitted job with its future, returns false if job was not submitted with Submit. In pools
+// passing on intervals failure is held until the job is settled as another copy of the job may have a result
+func (p *pipeline[J, R]) resolveError(jobErr JobError) bool {
+	if p.ordered && !errors.Is(jobErr.Err, ErrBatched) {
+		p.futuresMutex.Lock()
+		defer p.futuresMutex.Unlock()
+		if _, ok := p.futures[jobErr.JobID]; !ok {
+			return false
+		}
+		if failure, ok := p.failures[jobErr.JobID]; !ok || errors.Is(failure.Err, ErrFiltered) {
+			p.failures[jobErr.JobID] = jobErr
+		}
+		return true
+	}
+	future := p.takeFuture(jobErr.JobID)
+	if future == nil {
+		return false
+	}
+	var result R
+	future.resolve(result, jobErr)
+	return true
+}
+
+// Resize workers of first stage to n
+func (p *pipeline[J, R]) Resize(n int) error {
+	return p.ResizeStage(1, n)
+}
+
+// ResizeStage resizes workers of stage to n, returns error if stage has no workers e.g. a batch stage
+func (p *pipeline[J, R]) ResizeStage(stage, n int) error {
+	s, err := p.control(stage)
+	if err != nil {
+		return err
+	}
+	return s.resize(n)
+}
+
+// Pause workers of all stages
+func (p *pipeline[J, R]) Pause() {
+	for _, s := range p.stages {
+		_ = s.pause(true)
+	}
+}
+
+// Resume workers of all stages
+func (p *pipeline[J, R]) Resume() {
+	for _, s := range p.stages {
+		_ = s.pause(false)
+	}
+}
+
+// Paused returns true if workers of all stages are paused
+func (p *pipeline[J, R]) Paused() bool {
+	for _, s := range p.stages {
+		if !s.stats().Paused {
+			return false
+		}
+	}
+	return true
+}
+
+// PauseStage pauses workers of stage, returns error if stage has no workers e.g. a batch stage
+func (p *pipeline[J, R]) PauseStage(stage int) error {
+	s, err := p.control(stage)
+	if err != nil {
+		return err
+	}
+	return s.pause(true)
+}
+
+// ResumeStage resumes workers of stage, returns error if stage has no workers e.g. a batch stage
+func (p *pipeline[J, R]) ResumeStage(stage int) error {
+	s, err := p.control(stage)
+	if err != nil {
+		return err
+	}
+	return s.pause(false)
+}
+
+// control of stage, returns error if stage has no workers
+func (p *pipeline[J, R]) control(stage int) (stageControl, error) {
+	s, ok := p.stages[stage]
+	if !ok {
+		return nil, fmt.Errorf("expected stage %d to be a stage with workers", stage)
+	}
+	return s, nil
+}
+
+// Shutdown see Pool.Shutdown
+func (p *pipeline[J, R]) Shutdown(ctx context.Context) error {
+	// jobs channel is closed once senders blocked in ordered window or on a full que returned
+	closed := make(chan struct{})
+	p.spawn(func() {
+		p.closeJobs()
+		close(closed)
+	})
+	err := waitDone(ctx, closed)
+	if err == nil {
+		err = waitDone(ctx, p.done)
+	}
+	if err != nil {
+		p.ctx.force()
+	}
+	p.goroutines.Wait()
+	return err
+}
+
+// waitDone waits for done to be closed, returns ctx.Err() if ctx is done first
+func waitDone(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats of stages with workers in order of stages
+func (p *pipeline[J, R]) Stats() []StageStats {
+	numbers := make([]int, 0, len(p.stages))
+	for stage := range p.stages {
+		numbers = append(numbers, stage)
+	}
+	sort.Ints(numbers)
+	stats := make([]StageStats, 0, len(numbers))
+	for _, stage := range numbers {
+		stats = append(stats, p.stages[stage].stats())
+	}
+	return stats
+}
+
+// Close closes job que and returns results channel of last stage
+func (p *pipeline[J, R]) Close() <-chan R {
+	p.closeJobs()
+	return p.results
+}
+
+func (p *pipeline[J, R]) Errors() []JobError {
+	<-p.done
+	return p.errors.list()
+}
+
+func (p *pipeline[J, R]) ErrorsChan() <-chan JobError {
+	return p.errors.channel()
+}
@@ -4,50 +4,189 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Pool to manage, interact with worker pool
 type Pool[J, R any] interface {
-	// SendJobs to job que
+	// SendJobs to job que, blocks while que is full. Jobs that can not be sent because pool is closed or its
+	// context is done are returned by Errors
 	SendJobs(jobs ...J)
-	// Close closes job que and returns results channel
+	// SendJobsPriority to job que with priority, jobs with higher priority are processed first in pools with
+	// Config.Priority. See SendJobs
+	SendJobsPriority(priority int, jobs ...J)
+	// SendJobsContext to job que, returns ErrPoolClosed if pool is closed or ctx.Err() if ctx is done before all jobs
+	// are sent
+	SendJobsContext(ctx context.Context, jobs ...J) error
+	// TrySend job to job que without blocking, returns false if que is full or pool is closed
+	TrySend(job J) bool
+	// Submit job to job que and return future to await its result. Results and errors of submitted jobs are
+	// delivered only to their future, not to results channel or Errors
+	Submit(ctx context.Context, job J) (*Future[R], error)
+	// Close closes job que and returns results channel, senders blocked on a full que return ErrPoolClosed
 	Close() <-chan R
+	// Shutdown closes job que, senders blocked on a full que return ErrPoolClosed, and waits for queued and in-flight
+	// jobs to complete until ctx is done, then cancels context of workers and records jobs left in queues as JobError
+	// with ErrShutdown. Results must be received for jobs to complete. Returns after all goroutines of the pool
+	// exited, with ctx.Err() if jobs were cancelled
+	Shutdown(ctx context.Context) error
 	// Errors returns slice of JobError, in case of successful retires intermittent errors are not returned.
-	// It will wait for results channel to be closed
+	// It will wait for results channel to be closed without consuming results
 	Errors() []JobError
+	// ErrorsChan returns channel of JobError delivered as they occur across all stages, errors that occurred before
+	// the first call are delivered first. It is closed after results channel is closed
+	ErrorsChan() <-chan JobError
+	// Resize workers of the pool to n, for chained pools workers of first stage. Extra workers retire after their
+	// current job. Returns ErrPoolClosed once all workers exited
+	Resize(n int) error
+	// ResizeStage resizes workers of stage to n, stage is numbered from 1 as in JobError.Stage
+	ResizeStage(stage, n int) error
+	// Pause workers of all stages from picking up jobs, jobs in progress are completed and queued jobs are held
+	// until Resume. Paused workers still exit once pool context is done
+	Pause()
+	// Resume workers of all stages paused by Pause or PauseStage
+	Resume()
+	// Paused returns true if workers of all stages are paused
+	Paused() bool
+	// PauseStage pauses workers of stage, stage is numbered from 1 as in JobError.Stage. Returns ErrPoolClosed once
+	// all workers exited
+	PauseStage(stage int) error
+	// ResumeStage resumes workers of stage paused by Pause or PauseStage
+	ResumeStage(stage int) error
+	// Stats of stages with workers
+	Stats() []StageStats
 }
 
+// StageStats of a stage with workers
+type StageStats struct {
+	// Stage number starting from 1 as in JobError.Stage
+	Stage int
+	// Name from Config.Name of the stage
+	Name string
+	// Size is current number of workers
+	Size int
+	// QueueDepth is number of jobs waiting in job que of the stage
+	QueueDepth int
+	// Processed jobs including failed ones and Busy time spent processing them
+	Processed uint64
+	Busy      time.Duration
+	// Throttles is number of times workers waited for rate limiter and Throttled total time spent waiting
+	Throttles uint64
+	Throttled time.Duration
+	// Paused is true while workers of the stage hold off picking up jobs
+	Paused bool
+}
+
+// JobError for a job that failed after all attempts
 type JobError struct {
+	// Job that failed, of input type of the stage. For results of last stage that could not be delivered due to
+	// context cancellation it is the result
 	Job any
 	Err error
+	// JobID of the job submitted to first stage this job originates from, IDs start from 1 in order of SendJobs
+	JobID uint64
+	// Stage number starting from 1 where job failed
+	Stage int
+	// StageName from Config.Name of the stage
+	StageName string
+	// Attempts made for the job
+	Attempts int
+	// Permanent is true if Err was classified as not retryable
+	Permanent bool
+	// Started is time of first attempt, zero if job was never attempted
+	Started time.Time
+	// Failed is time job was recorded as failed
+	Failed time.Time
 }
 
+func (e JobError) Error() string {
+	return e.Err.Error()
+}
+
+func (e JobError) Unwrap() error {
+	return e.Err
+}
+
+// StageError is JobError with job of type T
+type StageError[T any] struct {
+	JobError
+	Job T
+}
+
+// AsStageError returns StageError[T] for jobErr if its job is of type T
+func AsStageError[T any](jobErr JobError) (StageError[T], bool) {
+	job, ok := jobErr.Job.(T)
+	if !ok {
+		return StageError[T]{}, false
+	}
+	return StageError[T]{jobErr, job}, true
+}
+
+// StageErrors returns errors of given stage with jobs of type T, i.e. input type of the stage
+func StageErrors[T any](jobErrors []JobError, stage int) []StageError[T] {
+	var stageErrors []StageError[T]
+	for _, jobErr := range jobErrors {
+		if jobErr.Stage != stage {
+			continue
+		}
+		if stageErr, ok := AsStageError[T](jobErr); ok {
+			stageErrors = append(stageErrors, stageErr)
+		}
+	}
+	return stageErrors
+}
+
+// singleStagePool is a stage of workers processing jobs from jobs channel
 type singleStagePool[J, R any] struct {
+	// processed jobs and nanoseconds spent processing them, waits for rate limiter and nanoseconds waited. First
+	// for 64-bit alignment required by atomic
+	processed uint64
+	busy      int64
+	throttles uint64
+	throttled int64
+	// backlog of jobs queued by scheduler
+	backlog int64
 	*Config[J, R]
+	*run
+	// stage number starting from 1
+	stage   int
 	running int
+	// workers started, last worker ID
+	workers int
+	// retiring is number of workers to exit after their current job, wake is closed to wake idle workers for it
+	// or when stage is paused or resumed
+	retiring int
+	wake     chan struct{}
+	// paused is true while workers hold off picking up jobs
+	paused bool
+	// done is true once all workers exited and results channel is closed, exited is closed along with it
+	done   bool
+	exited chan struct{}
+	// limiter of rate jobs are started at, nil if not limited
+	limiter *RateLimiter
+	// released receives key of processed job if jobs are scheduled by key, nil otherwise
+	released chan string
+	// retries left from cumulative MaxRetry budget
+	retries int
 	mutex   sync.Mutex
-	jobs    chan J
-	results chan R
-	errors  []JobError
+	jobs    <-chan item[J]
+	// ready jobs for workers, same as jobs unless jobs are serialized by key
+	ready   <-chan item[J]
+	results chan item[R]
 }
 
 // NewPool creates new instance of worker pool and starts workers
 func NewPool[J, R any](ctx context.Context, config *Config[J, R]) (Pool[J, R], error) {
-	p := &singleStagePool[J, R]{
-		Config:  config,
-		running: config.Size,
-		mutex:   sync.Mutex{},
-	}
-	if err := p.validate(); err != nil {
-		return nil, err
-	}
-	p.startPool(ctx, make(chan J, p.JobQueueLimit), make(chan R, p.ResultQueueLimit))
-	return p, nil
+	return From(config).Build(ctx)
 }
 
 func (p *singleStagePool[J, R]) validate() error {
+	if p.err != nil {
+		return p.err
+	}
 	if p.Size <= 0 {
 		return errors.New("expected pool size to be more than 0")
 	}
@@ -57,71 +196,446 @@ func (p *singleStagePool[J, R]) validate() error {
 	if p.ResultQueueLimit <= 0 {
 		return errors.New("expected ResultQueueLimit to be than 0")
 	}
-	if p.Worker == nil {
+	if p.Worker == nil && p.FlatMap == nil && p.newWorker == nil {
 		return fmt.Errorf("expected worker func to be not nil")
 	}
+	if p.Worker != nil && p.FlatMap != nil || p.newWorker != nil && (p.Worker != nil || p.FlatMap != nil) {
+		return errors.New("expected only one of Worker, FlatMap and stateful worker to be set")
+	}
+	if p.ErrorQueueLimit < 0 {
+		return errors.New("expected ErrorQueueLimit to be 0 or more")
+	}
+	if p.OrderWindow < 0 {
+		return errors.New("expected OrderWindow to be 0 or more")
+	}
+	if p.PriorityAging < 0 {
+		return errors.New("expected PriorityAging to be 0 or more")
+	}
+	if p.JobTimeout < 0 {
+		return errors.New("expected JobTimeout to be 0 or more")
+	}
+	if p.MaxPerKey < 0 {
+		return errors.New("expected MaxPerKey to be 0 or more")
+	}
+	if p.Rate < 0 || p.Burst < 0 {
+		return errors.New("expected Rate and Burst to be 0 or more")
+	}
+	if p.RateLimiter != nil {
+		if err := p.RateLimiter.validate(); err != nil {
+			return err
+		}
+	}
+	if p.Autoscale != nil {
+		if err := p.Autoscale.validate(p.Size); err != nil {
+			return err
+		}
+	}
+	if p.RetryPolicy != nil {
+		return p.RetryPolicy.validate()
+	}
 	return nil
 }
 
-func (p *singleStagePool[J, R]) startPool(ctx context.Context, jobs chan J, results chan R) {
+func (p *singleStagePool[J, R]) startPool(r *run, stage int, jobs <-chan item[J], results chan item[R]) {
+	p.run = r
+	p.stage = stage
 	p.jobs = jobs
 	p.results = results
+	p.retries = p.MaxRetry
+	p.wake = make(chan struct{})
+	p.exited = make(chan struct{})
+	p.limiter = p.RateLimiter
+	if p.limiter == nil && p.Rate > 0 {
+		burst := p.Burst
+		if burst == 0 {
+			burst = 1
+		}
+		p.limiter = NewRateLimiter(p.Rate, burst)
+	}
+	p.ready = jobs
+	if p.scheduled() {
+		p.ready = p.schedule(jobs, p.JobQueueLimit)
+	}
+	r.stages[stage] = p
+	r.init.wait.Add(p.Size)
 	for index := 0; index < p.Size; index++ {
-		go p.startWorker(ctx)
+		p.spawnWorker(r.init)
+	}
+	if p.Autoscale != nil {
+		autoscale := p.Autoscale
+		r.spawn(func() {
+			p.autoscale(autoscale)
+		})
+	}
+}
+
+// spawnWorker with next worker ID, init is done once the worker is initialized. mutex must be held unless stage is
+// starting
+func (p *singleStagePool[J, R]) spawnWorker(init *workerInit) {
+	p.workers++
+	id := p.workers
+	p.spawn(func() {
+		p.startWorker(id, init)
+	})
+}
+
+func (p *singleStagePool[J, R]) startWorker(id int, init *workerInit) {
+	worker, closeWorker, err := p.initWorker(id)
+	if err != nil {
+		init.done(fmt.Errorf("worker %d of stage %d failed to init: %w", id, p.stage, err))
+		p.removeWorker()
+		return
+	}
+	init.done(nil)
+	if p.newWorker != nil {
+		state := &statefulWorker[J, R]{pool: p, id: id, worker: worker, close: closeWorker}
+		worker, closeWorker = state.invoke, state.closeState
+	}
+	// state of worker is closed before it is removed, so before results channel is closed by the last worker
+	closed := func() bool {
+		defer closeWorker()
+		return p.runWorker(worker)
+	}()
+	if closed {
+		p.removeWorker()
+	}
+}
+
+// runWorker picking up jobs until worker retires or jobs channel is closed, returns true if jobs channel is closed
+func (p *singleStagePool[J, R]) runWorker(worker func(context.Context, J) (R, error)) bool {
+	ctx := p.ctx
+	// results of a job, reused between jobs
+	var results []R
+	for {
+		ready, wake, retire := p.next()
+		if retire {
+			return false
+		}
+		// paused workers still exit once context is done
+		var done <-chan struct{}
+		if ready == nil {
+			done = ctx.Done()
+		}
+		select {
+		case job, ok := <-ready:
+			if !ok {
+				return true
+			}
+			if slots := p.queueSlots(); slots != nil {
+				<-slots
+			}
+			results = p.work(ctx, worker, job, results[:0])
+			if p.released != nil && !job.skip {
+				p.released <- job.key
+			}
+		case <-wake:
+		case <-done:
+		}
+	}
+}
+
+// work on job with worker and send its results, results slice is returned for reuse
+func (p *singleStagePool[J, R]) work(ctx context.Context, worker func(context.Context, J) (R, error), job item[J], results []R) []R {
+	// results of a batch belong to its first job
+	for _, part := range job.batched() {
+		send(ctx, p.results, skipped[R](part))
+	}
+	if job.skip {
+		p.skip(ctx, job)
+		return results
+	}
+	jobCtx := ctx
+	if job.ctx != nil {
+		jobCtx = job.ctx
+	}
+	err := ctx.Err()
+	if err == nil {
+		err = jobCtx.Err()
+	}
+	if err != nil {
+		p.addError(job.id, JobError{Job: job.value, Err: err})
+		p.skip(ctx, job)
+		return results
+	}
+	started := time.Now()
+	var jobErr *JobError
+	results, jobErr = p.process(jobCtx, worker, job.value, results)
+	atomic.AddUint64(&p.processed, 1)
+	atomic.AddInt64(&p.busy, int64(time.Since(started)))
+	if jobErr != nil {
+		p.addError(job.id, *jobErr)
+		p.skip(ctx, job)
+		return results
+	}
+	if len(results) == 0 {
+		if job.ctx != nil {
+			p.errors.resolveOnly(JobError{Job: job.value, JobID: job.id, Stage: p.stage, StageName: p.Name, Err: ErrFiltered})
+		}
+		p.skip(ctx, job)
+	}
+	var zero R
+	for index, result := range results {
+		p.sendResult(ctx, job, result, len(results), index)
+		results[index] = zero
+	}
+	return results
+}
+
+// sendResult of n results of job to results channel, result is recorded as JobError if context is done before it
+// can be sent
+func (p *singleStagePool[J, R]) sendResult(ctx context.Context, job item[J], result R, n, index int) {
+	next := item[R]{id: job.id, value: result, ctx: job.ctx}
+	next.offset, next.weight = job.split(n, index)
+	if !send(ctx, p.results, next) {
+		p.addError(job.id, JobError{Job: job.value, Err: ctx.Err()})
 	}
 }
 
-func (p *singleStagePool[J, R]) startWorker(ctx context.Context) {
+// skip passes on interval of job without results to next stage in ordered pools
+func (p *singleStagePool[J, R]) skip(ctx context.Context, job item[J]) {
+	if p.ordered {
+		send(ctx, p.results, item[R]{id: job.id, ctx: job.ctx, offset: job.offset, weight: job.weight, skip: true})
+	}
+}
+
+// process job with retries as per RetryPolicy or cumulative MaxRetry, results are appended to given slice.
+// Returns JobError if all attempts failed or with HandlePanic if Deadline or Retryable panicked
+func (p *singleStagePool[J, R]) process(ctx context.Context, worker func(context.Context, J) (R, error), job J, results []R) (_ []R, failed *JobError) {
 	if p.HandlePanic {
 		defer func() {
 			if r := recover(); r != nil {
-				log.Printf("panic in worker: %+v", r)
-				p.removeWorker()
+				failed = &JobError{Job: job, Err: &PanicError{Value: r, Stack: debug.Stack()}, Permanent: true}
 			}
 		}()
 	}
-	for job := range p.jobs {
-	ABC:
-		if result, err := p.Worker(ctx, job); err == nil {
-			p.results <- result
-		} else {
-			if p.MaxRetry > 0 {
-				p.MaxRetry--
-				goto ABC
-			} else {
-				p.errors = append(p.errors, JobError{
-					Job: job,
-					Err: err,
-				})
+	if deadliner, ok := any(job).(Deadliner); ok {
+		if deadline, ok := deadliner.Deadline(); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+	}
+	started := time.Now()
+	var delay time.Duration
+	for attempts := 1; ; attempts++ {
+		if err := p.throttle(ctx); err != nil {
+			return results, &JobError{Job: job, Err: err, Attempts: attempts - 1, Started: started}
+		}
+		attempt, err := p.invoke(ctx, worker, job, results)
+		if err == nil {
+			return attempt, nil
+		}
+		jobErr := &JobError{Job: job, Err: err, Attempts: attempts, Started: started}
+		if !p.retryable(err) {
+			jobErr.Permanent = true
+			return results, jobErr
+		}
+		var retry bool
+		if p.RetryPolicy != nil {
+			delay, retry = p.RetryPolicy.next(attempts, started, delay, err)
+		} else if retry = p.takeRetry(); retry {
+			delay, _ = retryAfter(err)
+		}
+		if !retry || sleep(ctx, delay) != nil {
+			return results, jobErr
+		}
+	}
+}
+
+// throttle waits for rate limiter of the stage
+func (p *singleStagePool[J, R]) throttle(ctx context.Context) error {
+	if p.limiter == nil {
+		return nil
+	}
+	waited, err := p.limiter.wait(ctx)
+	if waited > 0 {
+		atomic.AddUint64(&p.throttles, 1)
+		atomic.AddInt64(&p.throttled, int64(waited))
+	}
+	return err
+}
+
+// invoke worker or FlatMap for job with JobTimeout applied, results are appended to given slice
+func (p *singleStagePool[J, R]) invoke(ctx context.Context, worker func(context.Context, J) (R, error), job J, results []R) (_ []R, err error) {
+	if p.HandlePanic {
+		defer func() {
+			if r := recover(); r != nil {
+				err = &PanicError{Value: r, Stack: debug.Stack()}
 			}
+		}()
+	}
+	if p.JobTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.JobTimeout)
+		defer cancel()
+	}
+	if p.FlatMap != nil {
+		err = p.FlatMap(ctx, job, func(result R) {
+			results = append(results, result)
+		})
+	} else {
+		var result R
+		if result, err = worker(ctx, job); err == nil {
+			results = append(results, result)
 		}
 	}
-	p.removeWorker()
+	if err != nil && ctx.Err() == context.DeadlineExceeded && !errors.Is(err, context.DeadlineExceeded) {
+		err = &timeoutError{err}
+	}
+	return results, err
+}
+
+// retryable classifies err returned by Worker
+func (p *singleStagePool[J, R]) retryable(err error) bool {
+	if IsPermanent(err) {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return true
+}
+
+// takeRetry from cumulative MaxRetry budget, returns false if budget is exhausted
+func (p *singleStagePool[J, R]) takeRetry() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.retries <= 0 {
+		return false
+	}
+	p.retries--
+	return true
+}
+
+func (p *singleStagePool[J, R]) addError(id uint64, jobErr JobError) {
+	jobErr.JobID = id
+	jobErr.Stage = p.stage
+	jobErr.StageName = p.Name
+	jobErr.Failed = time.Now()
+	p.errors.add(p.ctx, jobErr)
 }
 
 func (p *singleStagePool[J, R]) removeWorker() {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
+	p.exit()
+}
+
+// exit of a worker, results channel is closed once all workers exited. mutex must be held
+func (p *singleStagePool[J, R]) exit() {
 	p.running--
 	if p.running == 0 {
+		p.done = true
 		close(p.results)
+		close(p.exited)
+	}
+}
+
+// next returns channel of jobs to pick up from, nil while stage is paused, channel closed to wake idle workers and
+// true if worker should retire as stage is shrinking
+func (p *singleStagePool[J, R]) next() (<-chan item[J], <-chan struct{}, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.retiring > 0 {
+		p.retiring--
+		p.exit()
+		return nil, nil, true
+	}
+	if p.paused && p.ctx.Err() == nil {
+		return nil, p.wake, false
+	}
+	return p.ready, p.wake, false
+}
+
+// resize stage to n workers, new workers are started right away while retiring workers exit after their current
+// job. Returns error of new workers that failed to init
+func (p *singleStagePool[J, R]) resize(n int) error {
+	if n <= 0 {
+		return errors.New("expected pool size to be more than 0")
+	}
+	p.mutex.Lock()
+	if p.done {
+		p.mutex.Unlock()
+		return ErrPoolClosed
 	}
+	diff := n - (p.running - p.retiring)
+	if diff < 0 {
+		p.retiring -= diff
+		p.wakeWorkers()
+		p.mutex.Unlock()
+		return nil
+	}
+	// workers about to retire are kept before starting new ones
+	kept := diff
+	if kept > p.retiring {
+		kept = p.retiring
+	}
+	p.retiring -= kept
+	p.running += diff - kept
+	init := newWorkerInit(diff - kept)
+	for index := 0; index < diff-kept; index++ {
+		p.spawnWorker(init)
+	}
+	p.mutex.Unlock()
+	return init.result()
+}
+
+// pause or resume workers of stage picking up jobs, jobs in progress are completed
+func (p *singleStagePool[J, R]) pause(paused bool) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.done {
+		return ErrPoolClosed
+	}
+	if p.paused != paused {
+		p.paused = paused
+		p.wakeWorkers()
+	}
+	return nil
+}
+
+// wakeWorkers waiting for jobs to check for retirement or pause, mutex must be held
+func (p *singleStagePool[J, R]) wakeWorkers() {
+	close(p.wake)
+	p.wake = make(chan struct{})
 }
 
-func (p *singleStagePool[J, R]) SendJobs(jobs ...J) {
-	for _, job := range jobs {
-		p.jobs <- job
+// queueSlots returns slots of job que if stage is the first stage of pool and its jobs are queued outside of jobs
+// channel, nil otherwise
+func (p *singleStagePool[J, R]) queueSlots() chan struct{} {
+	if p.stage == 1 {
+		return p.slots
 	}
+	return nil
 }
 
-func (p *singleStagePool[J, R]) Close() <-chan R {
-	close(p.jobs)
-	return p.results
+// queue returns depth and limit of job que of stage, including jobs held by priority queue or scheduler
+func (p *singleStagePool[J, R]) queue() (depth, limit int) {
+	if slots := p.queueSlots(); slots != nil {
+		return len(slots), cap(slots)
+	}
+	depth, limit = len(p.jobs), cap(p.jobs)
+	if p.scheduled() {
+		depth += int(atomic.LoadInt64(&p.backlog))
+		limit += p.JobQueueLimit
+	}
+	return depth, limit
 }
 
-func (p *singleStagePool[J, R]) Errors() []JobError {
-	select {
-	case <-p.results:
-		return p.errors
+func (p *singleStagePool[J, R]) stats() StageStats {
+	p.mutex.Lock()
+	size, paused := p.running-p.retiring, p.paused
+	p.mutex.Unlock()
+	depth, _ := p.queue()
+	return StageStats{
+		Stage:      p.stage,
+		Name:       p.Name,
+		Size:       size,
+		Paused:     paused,
+		QueueDepth: depth,
+		Processed:  atomic.LoadUint64(&p.processed),
+		Busy:       time.Duration(atomic.LoadInt64(&p.busy)),
+		Throttles:  atomic.LoadUint64(&p.throttles),
+		Throttled:  time.Duration(atomic.LoadInt64(&p.throttled)),
 	}
 }
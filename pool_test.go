@@ -4,8 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"math/rand"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -106,6 +111,1853 @@ func TestPoolCreationError(t *testing.T) {
 	}
 }
 
+func TestPoolRetryPolicy(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := map[int]int{}
+	worker := func(ctx context.Context, job int) (string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts[job]++
+		if attempts[job] < 3 {
+			return "", errors.New("some-error")
+		}
+		return fmt.Sprintf("%d processed", job), nil
+	}
+	config := DefaultConfig(5, worker)
+	config.RetryPolicy = NewRetryPolicy(3, 10*time.Millisecond, 50*time.Millisecond)
+	config.RetryPolicy.Jitter = FullJitter
+	p, err := NewPool(context.Background(), config)
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	p.SendJobs(1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+	count := 0
+	for range p.Close() {
+		count++
+	}
+	if count != 10 {
+		t.Errorf("missing results expected to be 10, got %d", count)
+	}
+	if len(p.Errors()) != 0 {
+		t.Errorf("expected errors be 0, got %d", len(p.Errors()))
+	}
+	for job, attempt := range attempts {
+		if attempt != 3 {
+			t.Errorf("expected job %d to be attempted 3 times, got %d", job, attempt)
+		}
+	}
+}
+
+func TestPoolRetryPolicyCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	worker := func(ctx context.Context, job int) (string, error) {
+		cancel()
+		return "", errors.New("some-error")
+	}
+	config := DefaultConfig(1, worker)
+	config.RetryPolicy = NewRetryPolicy(5, time.Hour, time.Hour)
+	p, err := NewPool(ctx, config)
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	start := time.Now()
+	p.SendJobs(1)
+	for range p.Close() {
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("expected cancelled backoff to return immediately, took %s", time.Since(start))
+	}
+	if len(p.Errors()) != 1 {
+		t.Errorf("expected errors be 1, got %d", len(p.Errors()))
+	}
+}
+
+func TestPoolRetryClassification(t *testing.T) {
+	errValidation := errors.New("validation-error")
+	errThrottled := errors.New("throttled")
+	worker := func(ctx context.Context, job int) (string, error) {
+		switch job % 3 {
+		case 0:
+			return "", Permanent(fmt.Errorf("job %d: %w", job, errValidation))
+		case 1:
+			return "", RetryAfter(errThrottled, time.Millisecond)
+		default:
+			return "", errors.New("not-retryable")
+		}
+	}
+	config := DefaultConfig(5, worker)
+	config.RetryPolicy = NewRetryPolicy(3, time.Hour, time.Hour)
+	config.Retryable = func(err error) bool {
+		return !strings.HasPrefix(err.Error(), "not-")
+	}
+	p, err := NewPool(context.Background(), config)
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	p.SendJobs(0, 1, 2)
+	for range p.Close() {
+	}
+	jobErrors := p.Errors()
+	if len(jobErrors) != 3 {
+		t.Fatalf("expected errors be 3, got %d", len(jobErrors))
+	}
+	for _, jobErr := range jobErrors {
+		switch jobErr.Job.(int) {
+		case 0:
+			if !jobErr.Permanent || jobErr.Attempts != 1 || !errors.Is(jobErr, errValidation) {
+				t.Errorf("expected permanent error after 1 attempt, got %+v", jobErr)
+			}
+		case 1:
+			if jobErr.Permanent || jobErr.Attempts != 3 || !errors.Is(jobErr, errThrottled) {
+				t.Errorf("expected retryable error after 3 attempts, got %+v", jobErr)
+			}
+		case 2:
+			if !jobErr.Permanent || jobErr.Attempts != 1 {
+				t.Errorf("expected classified permanent error after 1 attempt, got %+v", jobErr)
+			}
+		}
+	}
+}
+
+func TestPoolCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	worker := func(ctx context.Context, job int) (int, error) {
+		if job == 0 {
+			close(started)
+		}
+		<-ctx.Done()
+		return job, ctx.Err()
+	}
+	config := NewConfig(1, 2, 1, 0, false, worker)
+	p, err := NewThreeStagePool(ctx, config, DefaultConfig(2, worker), DefaultConfig(2, worker))
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	sent := make(chan struct{})
+	go func() {
+		// blocks on full job queue until cancelled
+		p.SendJobs(0, 1, 2, 3, 4, 5)
+		close(sent)
+	}()
+	<-started
+	cancel()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("expected SendJobs to be unblocked on cancel")
+	}
+	select {
+	case _, ok := <-p.Close():
+		if ok {
+			t.Errorf("expected no results after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected results channel to be closed on cancel")
+	}
+	jobErrors := p.Errors()
+	if len(jobErrors) != 6 {
+		t.Errorf("expected errors be 6, got %d", len(jobErrors))
+	}
+	for _, jobErr := range jobErrors {
+		if !errors.Is(jobErr, context.Canceled) {
+			t.Errorf("expected error to be context.Canceled, got %v", jobErr.Err)
+		}
+	}
+}
+
+type deadlineJob struct {
+	id       int
+	deadline time.Time
+}
+
+func (j deadlineJob) Deadline() (time.Time, bool) {
+	return j.deadline, !j.deadline.IsZero()
+}
+
+func TestPoolJobTimeout(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := map[int]int{}
+	worker := func(ctx context.Context, job deadlineJob) (int, error) {
+		mutex.Lock()
+		attempts[job.id]++
+		attempt := attempts[job.id]
+		mutex.Unlock()
+		if job.id == 1 && attempt > 1 {
+			return job.id, nil
+		}
+		<-ctx.Done()
+		return 0, errors.New("hung job")
+	}
+	config := DefaultConfig(2, worker)
+	config.JobTimeout = 10 * time.Millisecond
+	config.RetryPolicy = NewRetryPolicy(5, time.Millisecond, time.Millisecond)
+	p, err := NewPool(context.Background(), config)
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	// job 1 times out once then succeeds, job 2 exceeds its own deadline before attempts are exhausted
+	p.SendJobs(deadlineJob{id: 1}, deadlineJob{id: 2, deadline: time.Now().Add(15 * time.Millisecond)})
+	count := 0
+	for range p.Close() {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("missing results expected to be 1, got %d", count)
+	}
+	jobErrors := p.Errors()
+	if len(jobErrors) != 1 {
+		t.Fatalf("expected errors be 1, got %d", len(jobErrors))
+	}
+	if !errors.Is(jobErrors[0], context.DeadlineExceeded) {
+		t.Errorf("expected error to wrap context.DeadlineExceeded, got %v", jobErrors[0].Err)
+	}
+	if jobErrors[0].Attempts >= 5 {
+		t.Errorf("expected job deadline to stop retries before 5 attempts, got %d", jobErrors[0].Attempts)
+	}
+}
+
+func TestPoolPanic(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := map[int]int{}
+	worker := func(ctx context.Context, job int) (string, error) {
+		mutex.Lock()
+		attempts[job]++
+		attempt := attempts[job]
+		mutex.Unlock()
+		if job%2 == 0 || attempt == 1 {
+			panic(fmt.Sprintf("job %d panicked", job))
+		}
+		return fmt.Sprintf("%d processed", job), nil
+	}
+	config := NewConfig(2, 10, 10, 0, true, worker)
+	config.RetryPolicy = NewRetryPolicy(2, 0, 0)
+	p, err := NewPool(context.Background(), config)
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	p.SendJobs(1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+	count := 0
+	for range p.Close() {
+		count++
+	}
+	if count != 5 {
+		t.Errorf("missing results expected to be 5, got %d", count)
+	}
+	jobErrors := p.Errors()
+	if len(jobErrors) != 5 {
+		t.Fatalf("expected errors be 5, got %d", len(jobErrors))
+	}
+	for _, jobErr := range jobErrors {
+		var panicErr *PanicError
+		if !errors.As(jobErr, &panicErr) {
+			t.Fatalf("expected error to be *PanicError, got %T", jobErr.Err)
+		}
+		if panicErr.Value != fmt.Sprintf("job %d panicked", jobErr.Job) || len(panicErr.Stack) == 0 {
+			t.Errorf("expected recovered value and stack, got %+v", panicErr)
+		}
+		if jobErr.Attempts != 2 {
+			t.Errorf("expected job %v to be attempted 2 times, got %d", jobErr.Job, jobErr.Attempts)
+		}
+	}
+
+	// panics outside of worker fail the job
+	config = NewConfig(1, 1, 10, 0, true, func(ctx context.Context, job int) (string, error) {
+		if job == 2 {
+			return "", errors.New("some-error")
+		}
+		return strconv.Itoa(job), nil
+	})
+	config.Retryable = func(err error) bool {
+		panic("retryable panicked")
+	}
+	config.SerializeByKey = true
+	config.KeyFunc = func(job int) string {
+		if job == 1 {
+			panic("key panicked")
+		}
+		return strconv.Itoa(job)
+	}
+	p, err = NewPool(context.Background(), config)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p.SendJobs(1, 2, 3, 4)
+	count = 0
+	for range p.Close() {
+		count++
+	}
+	jobErrors = p.Errors()
+	if count != 2 || len(jobErrors) != 2 {
+		t.Fatalf("expected 2 results and 2 errors, got %d and %v", count, jobErrors)
+	}
+	for _, jobErr := range jobErrors {
+		var panicErr *PanicError
+		if !errors.As(jobErr, &panicErr) {
+			t.Errorf("expected error of job %v to be *PanicError, got %v", jobErr.Job, jobErr.Err)
+		}
+	}
+}
+
+func TestPoolErrorsChan(t *testing.T) {
+	received := make(chan struct{})
+	worker := func(ctx context.Context, job int) (int, error) {
+		if job == 1 {
+			return 0, errors.New("some-error")
+		}
+		// job 2 waits until error of job 1 is received while pool is running
+		<-received
+		return job, nil
+	}
+	p, err := NewTwoStagePool(context.Background(), DefaultConfig(2, worker), DefaultConfig(2, worker))
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	p.SendJobs(1, 2)
+	errorsChan := p.ErrorsChan()
+	select {
+	case jobErr := <-errorsChan:
+		if jobErr.Job != 1 {
+			t.Errorf("expected error for job 1, got %v", jobErr.Job)
+		}
+		close(received)
+	case <-time.After(time.Second):
+		t.Fatal("expected error to be streamed before results channel is closed")
+	}
+	results := p.Close()
+	if len(p.Errors()) != 1 {
+		t.Errorf("expected errors be 1, got %d", len(p.Errors()))
+	}
+	count := 0
+	for range results {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("expected Errors to not consume results, got %d results", count)
+	}
+	if _, ok := <-errorsChan; ok {
+		t.Errorf("expected errors channel to be closed")
+	}
+}
+
+func TestPoolStress(t *testing.T) {
+	const jobs = 7000
+	// worker for stage fails every job where job%7 equals stage
+	stage := func(stage int) *Config[int, int] {
+		return NewConfig(8, 64, jobs, 100, true, func(ctx context.Context, job int) (int, error) {
+			if job%7 == stage {
+				return 0, fmt.Errorf("stage %d failed", stage)
+			}
+			return job, nil
+		})
+	}
+	ctx := context.Background()
+	tests := []struct {
+		stages int
+		pool   func() (Pool[int, int], error)
+	}{
+		{1, func() (Pool[int, int], error) { return NewPool(ctx, stage(1)) }},
+		{2, func() (Pool[int, int], error) { return NewTwoStagePool(ctx, stage(1), stage(2)) }},
+		{3, func() (Pool[int, int], error) { return NewThreeStagePool(ctx, stage(1), stage(2), stage(3)) }},
+		{4, func() (Pool[int, int], error) {
+			return NewFourStagePool(ctx, stage(1), stage(2), stage(3), stage(4))
+		}},
+		{5, func() (Pool[int, int], error) {
+			return NewFiveStagePools(ctx, stage(1), stage(2), stage(3), stage(4), stage(5))
+		}},
+		{6, func() (Pool[int, int], error) {
+			return NewSixStagePool(ctx, stage(1), stage(2), stage(3), stage(4), stage(5), stage(6))
+		}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("stages_%d", test.stages), func(t *testing.T) {
+			p, err := test.pool()
+			if err != nil {
+				t.Fatalf("expected nil error, got %v", err)
+			}
+			streamed := 0
+			streamDone := make(chan struct{})
+			go func() {
+				for range p.ErrorsChan() {
+					streamed++
+				}
+				close(streamDone)
+			}()
+			var wg sync.WaitGroup
+			for sender := 0; sender < 7; sender++ {
+				wg.Add(1)
+				go func(sender int) {
+					defer wg.Done()
+					for job := sender; job < jobs; job += 7 {
+						p.SendJobs(job)
+					}
+				}(sender)
+			}
+			wg.Wait()
+			count := 0
+			for range p.Close() {
+				count++
+			}
+			<-streamDone
+			expectedErrors := jobs / 7 * test.stages
+			if count != jobs-expectedErrors {
+				t.Errorf("expected results be %d, got %d", jobs-expectedErrors, count)
+			}
+			if len(p.Errors()) != expectedErrors {
+				t.Errorf("expected errors be %d, got %d", expectedErrors, len(p.Errors()))
+			}
+			if streamed != expectedErrors {
+				t.Errorf("expected streamed errors be %d, got %d", expectedErrors, streamed)
+			}
+		})
+	}
+}
+
+func TestPoolStageErrors(t *testing.T) {
+	toString := func(ctx context.Context, job int) (string, error) {
+		return strconv.Itoa(job), nil
+	}
+	parse := func(ctx context.Context, job string) (int, error) {
+		n, err := strconv.Atoi(job)
+		if n%4 == 0 {
+			return 0, fmt.Errorf("%d is divisible by 4", n)
+		}
+		return n, err
+	}
+	atoi := func(ctx context.Context, job string) (int, error) {
+		return strconv.Atoi(job)
+	}
+	config4 := DefaultConfig(2, parse)
+	config4.Name = "parse"
+	p, err := NewFourStagePool(context.Background(), DefaultConfig(2, toString), DefaultConfig(2, atoi), DefaultConfig(2, toString), config4)
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	// job IDs follow SendJobs order
+	p.SendJobs(1, 2, 3, 4, 5, 6, 7, 8)
+	for range p.Close() {
+	}
+	jobErrors := p.Errors()
+	if len(jobErrors) != 2 {
+		t.Fatalf("expected errors be 2, got %d", len(jobErrors))
+	}
+	if stageErrors := StageErrors[string](jobErrors, 4); len(stageErrors) != 2 {
+		t.Errorf("expected stage 4 errors be 2, got %d", len(stageErrors))
+	}
+	for _, stageErr := range StageErrors[string](jobErrors, 4) {
+		if stageErr.StageName != "parse" {
+			t.Errorf("expected stage name to be 'parse', got '%s'", stageErr.StageName)
+		}
+		if stageErr.Job != strconv.FormatUint(stageErr.JobID, 10) {
+			t.Errorf("expected job '%s' to originate from job ID %d", stageErr.Job, stageErr.JobID)
+		}
+		if stageErr.Attempts != 1 || stageErr.Started.IsZero() || stageErr.Failed.Before(stageErr.Started) {
+			t.Errorf("expected attempts and timestamps to be recorded, got %+v", stageErr.JobError)
+		}
+	}
+}
+
+func TestPoolSubmit(t *testing.T) {
+	double := func(ctx context.Context, job int) (int, error) {
+		if job < 0 {
+			return 0, errors.New("negative job")
+		}
+		if job == 0 {
+			<-ctx.Done()
+			return 0, ctx.Err()
+		}
+		return job * 2, nil
+	}
+	p, err := NewTwoStagePool(context.Background(), DefaultConfig(5, double), DefaultConfig(5, double))
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	ctx := context.Background()
+	futures := map[int]*Future[int]{}
+	for job := 1; job <= 10; job++ {
+		p.SendJobs(job)
+		if futures[job], err = p.Submit(ctx, job); err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+	}
+	failing, _ := p.Submit(ctx, -1)
+	cancelled, _ := p.Submit(ctx, 0)
+	for job, future := range futures {
+		if result, err := future.Wait(ctx); err != nil || result != job*4 {
+			t.Errorf("expected result of job %d to be %d, got %d, %v", job, job*4, result, err)
+		}
+	}
+	var jobErr JobError
+	if _, err := failing.Wait(ctx); !errors.As(err, &jobErr) || jobErr.Stage != 1 || jobErr.JobID != failing.ID() {
+		t.Errorf("expected JobError of stage 1, got %v", err)
+	}
+	cancelled.Cancel()
+	<-cancelled.Done()
+	if _, err := cancelled.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled error, got %v", err)
+	}
+	count := 0
+	for range p.Close() {
+		count++
+	}
+	if count != 10 {
+		t.Errorf("expected results of submitted jobs not on results channel, got %d results", count)
+	}
+	if len(p.Errors()) != 0 {
+		t.Errorf("expected errors of submitted jobs not in Errors, got %d", len(p.Errors()))
+	}
+	if _, err := p.Submit(ctx, 1); err != ErrPoolClosed {
+		t.Errorf("expected ErrPoolClosed, got %v", err)
+	}
+}
+
+func TestPoolSendClosed(t *testing.T) {
+	release := make(chan struct{})
+	worker := func(ctx context.Context, job int) (int, error) {
+		<-release
+		return job, nil
+	}
+	p, err := NewTwoStagePool(context.Background(), NewConfig(1, 1, 10, 0, false, worker), DefaultConfig(1, worker))
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	// first job is picked by the only worker, second fills the job que
+	p.SendJobs(1, 2)
+	for len(p.(*pipeline[int, int]).jobs) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if p.TrySend(3) {
+		t.Errorf("expected TrySend to fail on full que")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.SendJobsContext(ctx, 3); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	close(release)
+	results := p.Close()
+	if err := p.SendJobsContext(context.Background(), 3); err != ErrPoolClosed {
+		t.Errorf("expected ErrPoolClosed, got %v", err)
+	}
+	if p.TrySend(3) {
+		t.Errorf("expected TrySend to fail on closed pool")
+	}
+	p.SendJobs(3)
+	count := 0
+	for range results {
+		count++
+	}
+	if count != 2 {
+		t.Errorf("expected results be 2, got %d", count)
+	}
+	jobErrors := p.Errors()
+	if len(jobErrors) != 1 || jobErrors[0].Err != ErrPoolClosed {
+		t.Errorf("expected job sent after close to fail with ErrPoolClosed, got %v", jobErrors)
+	}
+
+	// sender blocked on full que returns once pool is closed, results are received only after Close returns
+	p2, err := NewPool(context.Background(), NewConfig(1, 1, 1, 0, false, func(ctx context.Context, job int) (int, error) {
+		return job, nil
+	}))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		p2.SendJobs(1, 2, 3, 4, 5, 6)
+	}()
+	for p2.Stats()[0].QueueDepth != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	closed := make(chan (<-chan int))
+	go func() {
+		closed <- p2.Close()
+	}()
+	select {
+	case results = <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected Close to return while a sender is blocked on full que")
+	}
+	// TrySend and SendJobsContext do not wait for closing pool
+	if p2.TrySend(7) || p2.SendJobsContext(context.Background(), 7) != ErrPoolClosed {
+		t.Error("expected TrySend and SendJobsContext to fail on closed pool")
+	}
+	count = 0
+	for range results {
+		count++
+	}
+	<-sent
+	unsent := 0
+	for _, jobErr := range p2.Errors() {
+		if jobErr.Err == ErrPoolClosed {
+			unsent++
+		}
+	}
+	if count+unsent != 6 || unsent == 0 {
+		t.Errorf("expected jobs of blocked sender to be processed or fail with ErrPoolClosed, got %d results and %v", count, p2.Errors())
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	increment := DefaultConfig(2, func(ctx context.Context, job int) (int, error) {
+		return job + 1, nil
+	})
+	toString := DefaultConfig(2, func(ctx context.Context, job int) (string, error) {
+		return strconv.Itoa(job), nil
+	})
+	b := From(increment)
+	for stage := 2; stage <= 10; stage++ {
+		b = Then(b, increment)
+	}
+	p, err := Then(b, toString).Build(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p.SendJobs(0, 10, 20)
+	results := map[string]bool{}
+	for result := range p.Close() {
+		results[result] = true
+	}
+	if len(results) != 3 || !results["10"] || !results["20"] || !results["30"] {
+		t.Errorf("expected results to be incremented by 10 stages, got %v", results)
+	}
+	if _, err := Then(Then(b, (*Config[int, int])(nil)), toString).Build(context.Background()); err == nil {
+		t.Errorf("expected error for nil config")
+	}
+}
+
+func TestPoolFilterFlatMap(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := map[int]int{}
+	// emits job copies of every job, first attempt of job 3 fails after emitting
+	expand := DefaultFlatMapConfig(2, func(ctx context.Context, job int, emit func(int)) error {
+		for i := 0; i < job; i++ {
+			emit(job*10 + i + 1)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if attempts[job]++; job == 3 && attempts[job] == 1 {
+			return errors.New("some-error")
+		}
+		return nil
+	})
+	expand.MaxRetry = 1
+	even := DefaultFilterConfig(2, func(ctx context.Context, job int) (bool, error) {
+		return job%2 == 0, nil
+	})
+	toString := DefaultConfig(2, func(ctx context.Context, job int) (string, error) {
+		return strconv.Itoa(job), nil
+	})
+	p, err := NewThreeStagePool(context.Background(), expand, even, toString)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p.SendJobs(1, 2, 3)
+	filtered, _ := p.Submit(context.Background(), 1)
+	var results []string
+	for result := range p.Close() {
+		results = append(results, result)
+	}
+	sort.Strings(results)
+	if strings.Join(results, ",") != "22,32" {
+		t.Errorf("expected results 22,32 got %v", results)
+	}
+	if _, err := filtered.Wait(context.Background()); !errors.Is(err, ErrFiltered) {
+		t.Errorf("expected ErrFiltered, got %v", err)
+	}
+	if len(p.Errors()) != 0 {
+		t.Errorf("expected errors be 0, got %d", len(p.Errors()))
+	}
+}
+
+func TestBatch(t *testing.T) {
+	identity := DefaultConfig(1, func(ctx context.Context, job int) (int, error) {
+		return job, nil
+	})
+	// bulk stage returns size of batch
+	size := DefaultConfig(1, func(ctx context.Context, batch []int) (int, error) {
+		return len(batch), nil
+	})
+	p, err := Then(Batch(From(identity), 3, 50*time.Millisecond), size).Build(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p.SendJobs(1, 2, 3, 4, 5, 6, 7)
+	results := p.Close()
+	if first, second := <-results, <-results; first != 3 || second != 3 {
+		t.Errorf("expected full batches of 3, got %d and %d", first, second)
+	}
+	start := time.Now()
+	if last := <-results; last != 1 {
+		t.Errorf("expected last batch of 1, got %d", last)
+	}
+	if time.Since(start) > 40*time.Millisecond {
+		t.Errorf("expected last batch to be flushed when jobs are closed, took %s", time.Since(start))
+	}
+
+	p, err = Unbatch(Then(Batch(From(identity), 4, 10*time.Millisecond), DefaultConfig(1, func(ctx context.Context, batch []int) ([]int, error) {
+		for index := range batch {
+			batch[index] *= 10
+		}
+		return batch, nil
+	}))).Build(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	// batch is flushed after linger while pool is open
+	p.SendJobs(1, 2)
+	if result := <-p.(*pipeline[int, int]).results; result != 10 {
+		t.Errorf("expected first result to be 10, got %d", result)
+	}
+	p.SendJobs(3)
+	sum := 0
+	for result := range p.Close() {
+		sum += result
+	}
+	if sum != 50 {
+		t.Errorf("expected sum of remaining results to be 50, got %d", sum)
+	}
+	if _, err := Batch(From(identity), 0, 0).Build(context.Background()); err == nil {
+		t.Errorf("expected error for batch size 0")
+	}
+}
+
+func TestPoolOrdered(t *testing.T) {
+	release := make(chan struct{})
+	// job 1 holds up results of jobs sent after it until released
+	config := DefaultConfig(4, func(ctx context.Context, job int) (int, error) {
+		if job == 1 {
+			<-release
+		}
+		if job == 5 {
+			return 0, Permanent(errors.New("some-error"))
+		}
+		return job * 10, nil
+	})
+	config.Ordered = true
+	config.OrderWindow = 3
+	p, err := NewPool(context.Background(), config)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p.SendJobs(1, 2, 3)
+	if p.TrySend(4) {
+		t.Error("expected TrySend to fail while order window is full")
+	}
+	close(release)
+	p.SendJobs(4, 5, 6)
+	var results []string
+	for result := range p.Close() {
+		results = append(results, strconv.Itoa(result))
+	}
+	if strings.Join(results, ",") != "10,20,30,40,60" {
+		t.Errorf("expected results 10,20,30,40,60 got %v", results)
+	}
+	if jobErrors := p.Errors(); len(jobErrors) != 1 || jobErrors[0].JobID != 5 {
+		t.Errorf("expected error for job 5, got %v", jobErrors)
+	}
+}
+
+func TestPoolOrderedStages(t *testing.T) {
+	// emits job copies of every job, later jobs complete first
+	expand := DefaultFlatMapConfig(4, func(ctx context.Context, job int, emit func(int)) error {
+		time.Sleep(time.Duration(10-job) * time.Millisecond)
+		if job == 4 {
+			return Permanent(errors.New("some-error"))
+		}
+		for i := 0; i < job; i++ {
+			emit(job*10 + i + 1)
+		}
+		return nil
+	})
+	expand.Ordered = true
+	odd := DefaultFilterConfig(4, func(ctx context.Context, job int) (bool, error) {
+		return job%2 == 1, nil
+	})
+	toString := DefaultConfig(4, func(ctx context.Context, job int) (string, error) {
+		return strconv.Itoa(job), nil
+	})
+	b := Then(Unbatch(Batch(Then(From(expand), odd), 2, time.Millisecond)), toString)
+	p, err := b.Build(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p.SendJobs(1, 2, 3, 4, 5, 6)
+	var results []string
+	for result := range p.Close() {
+		results = append(results, result)
+	}
+	expected := "11,21,31,33,51,53,55,61,63,65"
+	if strings.Join(results, ",") != expected {
+		t.Errorf("expected results %s got %v", expected, results)
+	}
+	if len(p.Errors()) != 1 {
+		t.Errorf("expected errors be 1, got %d", len(p.Errors()))
+	}
+}
+
+func TestRoute(t *testing.T) {
+	identity := DefaultConfig(2, func(ctx context.Context, job int) (int, error) {
+		return job, nil
+	})
+	format := func(name, prefix string) *Config[int, string] {
+		config := DefaultConfig(2, func(ctx context.Context, job int) (string, error) {
+			if job == 9 {
+				return "", Permanent(errors.New("some-error"))
+			}
+			return prefix + strconv.Itoa(job), nil
+		})
+		config.Name = name
+		return config
+	}
+	// odd jobs go to second branch, jobs more than 10 have no route
+	router := func(job int) int {
+		if job > 10 {
+			return 2
+		}
+		return job % 2
+	}
+	evens := From(format("even", "e"))
+	odds := Then(From(identity), format("odd", "o"))
+	p, err := Route(From(identity), router, evens, odds).Build(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p.SendJobs(1, 2, 3, 4, 9, 11)
+	var results []string
+	for result := range p.Close() {
+		results = append(results, result)
+	}
+	sort.Strings(results)
+	if strings.Join(results, ",") != "e2,e4,o1,o3" {
+		t.Errorf("expected results e2,e4,o1,o3 got %v", results)
+	}
+	jobErrors := p.Errors()
+	sort.Slice(jobErrors, func(i, j int) bool {
+		return jobErrors[i].Stage < jobErrors[j].Stage
+	})
+	if len(jobErrors) != 2 || !errors.Is(jobErrors[0], ErrNoRoute) || jobErrors[0].Stage != 2 {
+		t.Fatalf("expected ErrNoRoute at stage 2, got %v", jobErrors)
+	}
+	// stages are route, even, identity and odd
+	if jobErrors[1].Stage != 5 || jobErrors[1].StageName != "odd" {
+		t.Errorf("expected error of job 9 at stage 5 odd, got %d %s", jobErrors[1].Stage, jobErrors[1].StageName)
+	}
+
+	config := DefaultConfig(2, func(ctx context.Context, job int) (int, error) {
+		time.Sleep(time.Duration(5-job) * time.Millisecond)
+		return job, nil
+	})
+	config.Ordered = true
+	p, err = Tee(From(config), From(format("", "a")), From(format("", "b"))).Build(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p.SendJobs(1, 2, 3, 4)
+	results = nil
+	for result := range p.Close() {
+		results = append(results, result)
+	}
+	if strings.Join(results, ",") != "a1,b1,a2,b2,a3,b3,a4,b4" {
+		t.Errorf("expected results a1,b1,a2,b2,a3,b3,a4,b4 got %v", results)
+	}
+	if _, err := Route[int, int, string](From(identity), nil, evens).Build(context.Background()); err == nil {
+		t.Error("expected error for nil router")
+	}
+	if _, err := Tee[int, int, string](From(identity)).Build(context.Background()); err == nil {
+		t.Error("expected error for no branches")
+	}
+
+	// future of teed job resolves with a result of any branch, failures only once all copies are accounted for
+	same := func(ctx context.Context, job int) (int, error) {
+		return job, nil
+	}
+	slow := func(ctx context.Context, job int) (int, error) {
+		time.Sleep(10 * time.Millisecond)
+		return job, nil
+	}
+	filterAll := DefaultFilterConfig(1, func(ctx context.Context, job int) (bool, error) {
+		return false, nil
+	})
+	failing := DefaultConfig(1, func(ctx context.Context, job int) (int, error) {
+		return 0, errors.New("some-error")
+	})
+	teed, err := Tee(From(DefaultConfig(1, same)), From(DefaultConfig(1, same)), From(DefaultConfig(1, slow)), From(filterAll)).Build(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	future, err := teed.Submit(context.Background(), 7)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if result, err := future.Wait(context.Background()); result != 7 || err != nil {
+		t.Errorf("expected teed job to resolve with result 7, got %d and %v", result, err)
+	}
+	teed.Close()
+	teed, err = Tee(From(DefaultConfig(1, same)), From(filterAll), From(failing), From(filterAll)).Build(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	future, err = teed.Submit(context.Background(), 7)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if _, err := future.Wait(context.Background()); err == nil || errors.Is(err, ErrFiltered) {
+		t.Errorf("expected teed job to resolve with error of failed branch, got %v", err)
+	}
+	teed.Close()
+	if len(teed.Errors()) != 0 {
+		t.Errorf("expected errors of submitted job to be delivered only to its future, got %v", teed.Errors())
+	}
+}
+
+func TestMerge(t *testing.T) {
+	var results []<-chan int
+	for i := 0; i < 3; i++ {
+		p, err := NewPool(context.Background(), DefaultConfig(2, func(ctx context.Context, job int) (int, error) {
+			return job, nil
+		}))
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		p.SendJobs(i, i+10)
+		results = append(results, p.Close())
+	}
+	sum := 0
+	for result := range Merge(context.Background(), results...) {
+		sum += result
+	}
+	if sum != 36 {
+		t.Errorf("expected sum of results to be 36, got %d", sum)
+	}
+}
+
+func TestDAG(t *testing.T) {
+	var mutex sync.Mutex
+	var order []string
+	// result of a task is its id followed by results of its dependencies
+	d, err := NewDAG(context.Background(), DefaultConfig(4, func(ctx context.Context, job DAGJob[int, string]) (string, error) {
+		mutex.Lock()
+		order = append(order, job.ID)
+		mutex.Unlock()
+		if job.Job < 0 {
+			return "", errors.New("some-error")
+		}
+		deps := make([]string, 0, len(job.Deps))
+		for _, dep := range job.Deps {
+			deps = append(deps, dep)
+		}
+		sort.Strings(deps)
+		return job.ID + "(" + strings.Join(deps, ",") + ")", nil
+	}))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	// test depends on build submitted later
+	submit := func(id string, job int, dependsOn ...string) {
+		if err := d.Submit(id, job, dependsOn...); err != nil {
+			t.Fatalf("expected nil error submitting %s, got %v", id, err)
+		}
+	}
+	submit("test", 1, "build")
+	submit("lint", 1)
+	submit("build", 1, "lint")
+	submit("release", 1, "test", "lint")
+	submit("broken", -1)
+	submit("docs", 1, "broken")
+	submit("publish", 1, "docs")
+	submit("orphan", 1, "missing")
+	if err := d.Submit("lint", 1); err == nil {
+		t.Error("expected error for duplicate task")
+	}
+	if err := d.Submit("missing", 1, "orphan"); !errors.Is(err, ErrCycle) {
+		t.Errorf("expected ErrCycle, got %v", err)
+	}
+	if err := d.Submit("self", 1, "self"); !errors.Is(err, ErrCycle) {
+		t.Errorf("expected ErrCycle for self dependency, got %v", err)
+	}
+	results, jobErrors := d.Wait()
+	if results["release"] != "release(lint(),test(build(lint())))" {
+		t.Errorf("expected result of release with its dependencies, got %s", results["release"])
+	}
+	position := map[string]int{}
+	for index, id := range order {
+		position[id] = index
+	}
+	if position["lint"] > position["build"] || position["build"] > position["test"] || position["test"] > position["release"] {
+		t.Errorf("expected tasks to run after their dependencies, got %v", order)
+	}
+	failed := map[string]error{}
+	for _, jobErr := range jobErrors {
+		var depErr *DependencyError
+		if errors.As(jobErr, &depErr) {
+			failed[depErr.ID] = jobErr
+		} else {
+			failed[jobErr.Job.(DAGJob[int, string]).ID] = jobErr
+		}
+	}
+	if len(failed) != 4 || failed["broken"] == nil || errors.Is(failed["broken"], ErrDependencyFailed) {
+		t.Fatalf("expected broken, docs, publish and orphan to fail, got %v", failed)
+	}
+	if !errors.Is(failed["publish"], ErrDependencyFailed) || !strings.Contains(failed["publish"].Error(), "some-error") {
+		t.Errorf("expected publish to be skipped due to broken, got %v", failed["publish"])
+	}
+	if !errors.Is(failed["orphan"], ErrMissingDependency) {
+		t.Errorf("expected orphan to be skipped with ErrMissingDependency, got %v", failed["orphan"])
+	}
+	if err := d.Submit("late", 1); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("expected ErrPoolClosed, got %v", err)
+	}
+}
+
+func TestPoolResize(t *testing.T) {
+	var active, peak int32
+	gate := make(chan struct{})
+	// negative jobs wait for gate
+	config := DefaultConfig(1, func(ctx context.Context, job int) (int, error) {
+		n := atomic.AddInt32(&active, 1)
+		for p := atomic.LoadInt32(&peak); n > p && !atomic.CompareAndSwapInt32(&peak, p, n); p = atomic.LoadInt32(&peak) {
+		}
+		if job < 0 {
+			<-gate
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		return job, nil
+	})
+	p, err := NewPool(context.Background(), config)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	stage := p.(*pipeline[int, int]).stages[1].(*singleStagePool[int, int])
+	waitFor := func(condition func() bool, message string) {
+		for start := time.Now(); !condition(); time.Sleep(time.Millisecond) {
+			if time.Since(start) > time.Second {
+				t.Fatal(message)
+			}
+		}
+	}
+	p.SendJobs(-1, -2, -3, -4)
+	if err := p.Resize(4); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	waitFor(func() bool {
+		return atomic.LoadInt32(&active) == 4
+	}, "expected 4 jobs to run after growing pool")
+	close(gate)
+	waitFor(func() bool {
+		return atomic.LoadInt32(&active) == 0
+	}, "expected jobs to complete")
+	if err := p.Resize(1); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	// idle workers retire right away
+	waitFor(func() bool {
+		stage.mutex.Lock()
+		defer stage.mutex.Unlock()
+		return stage.running == 1
+	}, "expected idle workers to retire after shrinking pool")
+	atomic.StoreInt32(&peak, 0)
+	p.SendJobs(1, 2, 3, 4, 5, 6)
+	sum := 0
+	for result := range p.Close() {
+		sum += result
+	}
+	if sum != 11 {
+		t.Errorf("expected sum of results to be 11, got %d", sum)
+	}
+	if peak != 1 {
+		t.Errorf("expected 1 job at a time after shrinking pool, got %d", peak)
+	}
+	if err := p.Resize(0); err == nil {
+		t.Error("expected error for size 0")
+	}
+	if err := p.ResizeStage(2, 1); err == nil {
+		t.Error("expected error for stage without workers")
+	}
+	if err := p.Resize(2); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("expected ErrPoolClosed, got %v", err)
+	}
+}
+
+func TestPoolAutoscale(t *testing.T) {
+	config := DefaultConfig(1, func(ctx context.Context, job int) (int, error) {
+		time.Sleep(2 * time.Millisecond)
+		return job, nil
+	})
+	config.Autoscale = &Autoscale{MinSize: 1, MaxSize: 4, Policy: QueueDepthPolicy(0), Interval: 2 * time.Millisecond}
+	p, err := NewPool(context.Background(), config)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	stage := p.(*pipeline[int, int]).stages[1].(*singleStagePool[int, int])
+	waitForSize := func(size int) {
+		for start := time.Now(); ; time.Sleep(time.Millisecond) {
+			stage.mutex.Lock()
+			current := stage.running - stage.retiring
+			stage.mutex.Unlock()
+			if current == size {
+				return
+			}
+			if time.Since(start) > 2*time.Second {
+				t.Fatalf("expected stage to scale to %d, got %d", size, current)
+			}
+		}
+	}
+	go func() {
+		for i := 0; i < 500; i++ {
+			p.SendJobs(i)
+		}
+	}()
+	waitForSize(4)
+	// consume results for workers to complete jobs
+	results := p.(*pipeline[int, int]).results
+	for i := 0; i < 500; i++ {
+		<-results
+	}
+	waitForSize(1)
+	p.Close()
+	if len(p.Errors()) != 0 {
+		t.Errorf("expected errors be 0, got %d", len(p.Errors()))
+	}
+	config.Autoscale = &Autoscale{MinSize: 2, MaxSize: 4, Policy: QueueDepthPolicy(0)}
+	if _, err := NewPool(context.Background(), config); err == nil {
+		t.Error("expected error for size less than Autoscale.MinSize")
+	}
+}
+
+func TestScalePolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   ScalePolicy
+		metrics  ScaleMetrics
+		expected int
+	}{
+		{"queue depth grows", QueueDepthPolicy(10), ScaleMetrics{Size: 4, QueueDepth: 11}, 5},
+		{"queue depth keeps", QueueDepthPolicy(10), ScaleMetrics{Size: 4, QueueDepth: 5}, 4},
+		{"queue depth shrinks", QueueDepthPolicy(10), ScaleMetrics{Size: 4, Utilization: 0.2}, 3},
+		{"queue depth busy", QueueDepthPolicy(10), ScaleMetrics{Size: 4, Utilization: 0.9}, 4},
+		{"latency grows", TargetLatencyPolicy(time.Second), ScaleMetrics{Size: 4, QueueDepth: 1, Wait: 2 * time.Second}, 5},
+		{"latency keeps", TargetLatencyPolicy(time.Second), ScaleMetrics{Size: 4, QueueDepth: 1, Wait: time.Millisecond}, 4},
+		{"latency shrinks", TargetLatencyPolicy(time.Second), ScaleMetrics{Size: 4, Utilization: 0.1}, 3},
+		{"aimd increases", AIMDPolicy(time.Second, 2, 0.5), ScaleMetrics{Size: 4, QueueDepth: 1, Processed: 1, Latency: time.Millisecond}, 6},
+		{"aimd decreases", AIMDPolicy(time.Second, 2, 0.5), ScaleMetrics{Size: 4, QueueDepth: 1, Processed: 1, Latency: 2 * time.Second}, 2},
+		{"aimd keeps", AIMDPolicy(time.Second, 2, 0.5), ScaleMetrics{Size: 4}, 4},
+	}
+	for _, test := range tests {
+		if size := test.policy(test.metrics); size != test.expected {
+			t.Errorf("%s: expected size %d, got %d", test.name, test.expected, size)
+		}
+	}
+}
+
+type priorityJob int
+
+func (j priorityJob) Priority() int {
+	return int(j) / 10
+}
+
+func TestPoolPriority(t *testing.T) {
+	newPool := func(aging time.Duration) (Pool[priorityJob, int], chan struct{}, *[]int) {
+		started, gate := make(chan struct{}), make(chan struct{})
+		var order []int
+		// job 0 blocks the only worker until gate is closed
+		config := DefaultConfig(1, func(ctx context.Context, job priorityJob) (int, error) {
+			if job == 0 {
+				close(started)
+				<-gate
+			}
+			order = append(order, int(job))
+			return int(job), nil
+		})
+		config.JobQueueLimit = 5
+		config.Priority = true
+		config.PriorityAging = aging
+		p, err := NewPool(context.Background(), config)
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		p.SendJobs(0)
+		<-started
+		return p, gate, &order
+	}
+	p, gate, order := newPool(0)
+	p.SendJobs(10, 30)
+	if !p.TrySend(20) {
+		t.Error("expected TrySend to succeed while job que has space")
+	}
+	p.SendJobsPriority(5, 1)
+	p.SendJobs(31)
+	if depth := p.Stats()[0].QueueDepth; depth != 5 {
+		t.Errorf("expected 5 jobs queued by priority, got %d", depth)
+	}
+	if p.TrySend(40) {
+		t.Error("expected TrySend to fail while JobQueueLimit jobs are queued")
+	}
+	close(gate)
+	for range p.Close() {
+	}
+	if fmt.Sprint(*order) != "[0 1 30 31 20 10]" {
+		t.Errorf("expected jobs in order of priority [0 1 30 31 20 10], got %v", *order)
+	}
+
+	// job 10 waits long enough to overtake job 50
+	p, gate, order = newPool(time.Millisecond)
+	p.SendJobs(10)
+	time.Sleep(20 * time.Millisecond)
+	p.SendJobs(50)
+	close(gate)
+	for range p.Close() {
+	}
+	if fmt.Sprint(*order) != "[0 10 50]" {
+		t.Errorf("expected aged job to be processed first [0 10 50], got %v", *order)
+	}
+}
+
+func TestPoolRateLimit(t *testing.T) {
+	identity := func(ctx context.Context, job int) (int, error) {
+		return job, nil
+	}
+	config := DefaultConfig(4, identity)
+	config.Rate = 100
+	p, err := NewPool(context.Background(), config)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	start := time.Now()
+	p.SendJobs(1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+	for range p.Close() {
+	}
+	if elapsed := time.Since(start); elapsed < 85*time.Millisecond {
+		t.Errorf("expected 10 jobs at 100 per second to take at least 90ms, took %s", elapsed)
+	}
+	if stats := p.Stats(); len(stats) != 1 || stats[0].Processed != 10 || stats[0].Throttles == 0 || stats[0].Throttled == 0 {
+		t.Errorf("expected stats with throttled jobs, got %+v", stats)
+	}
+
+	// limiter shared by two pools
+	limiter := NewRateLimiter(100, 2)
+	var pools []Pool[int, int]
+	for i := 0; i < 2; i++ {
+		config := DefaultConfig(2, identity)
+		config.RateLimiter = limiter
+		p, err := NewPool(context.Background(), config)
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		pools = append(pools, p)
+	}
+	start = time.Now()
+	for _, p := range pools {
+		p.SendJobs(1, 2, 3, 4, 5)
+	}
+	for _, p := range pools {
+		for range p.Close() {
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 75*time.Millisecond {
+		t.Errorf("expected 10 jobs shared at 100 per second with burst 2 to take at least 80ms, took %s", elapsed)
+	}
+	if stats := limiter.Stats(); stats.Waits == 0 || stats.Waited == 0 {
+		t.Errorf("expected waits of shared limiter, got %+v", stats)
+	}
+
+	config.RateLimiter = NewRateLimiter(0, 1)
+	if _, err := NewPool(context.Background(), config); err == nil {
+		t.Error("expected error for rate 0")
+	}
+}
+
+type event struct {
+	customer string
+	seq      int
+}
+
+func (e event) Key() string {
+	return e.customer
+}
+
+func TestPoolSerializeByKey(t *testing.T) {
+	var (
+		mutex  sync.Mutex
+		active = map[string]int{}
+		order  = map[string][]int{}
+		peak   int
+	)
+	config := DefaultConfig(4, func(ctx context.Context, job event) (int, error) {
+		mutex.Lock()
+		if active[job.customer]++; active[job.customer] > 1 {
+			t.Errorf("expected one job of %s at a time", job.customer)
+		}
+		running := 0
+		for _, n := range active {
+			running += n
+		}
+		if running > peak {
+			peak = running
+		}
+		order[job.customer] = append(order[job.customer], job.seq)
+		mutex.Unlock()
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		active[job.customer]--
+		mutex.Unlock()
+		return job.seq, nil
+	})
+	config.JobQueueLimit = 4
+	config.SerializeByKey = true
+	p, err := NewPool(context.Background(), config)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	customers := []string{"a", "b", "c"}
+	for seq := 0; seq < 30; seq++ {
+		p.SendJobs(event{customers[seq%3], seq})
+	}
+	count := 0
+	for range p.Close() {
+		count++
+	}
+	if count != 30 {
+		t.Errorf("expected results be 30, got %d", count)
+	}
+	for customer, seqs := range order {
+		if !sort.IntsAreSorted(seqs) || len(seqs) != 10 {
+			t.Errorf("expected 10 jobs of %s in order, got %v", customer, seqs)
+		}
+	}
+	if peak < 2 {
+		t.Errorf("expected jobs with different keys to run in parallel, got %d at most", peak)
+	}
+
+	var processed []int
+	config2 := DefaultConfig(2, func(ctx context.Context, job int) (int, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		processed = append(processed, job)
+		return job, nil
+	})
+	config2.SerializeByKey = true
+	config2.KeyFunc = func(job int) string {
+		return "same"
+	}
+	p2, err := NewPool(context.Background(), config2)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p2.SendJobs(1, 2, 3, 4, 5)
+	for range p2.Close() {
+	}
+	if fmt.Sprint(processed) != "[1 2 3 4 5]" {
+		t.Errorf("expected jobs with same key in order, got %v", processed)
+	}
+
+	// jobs held by scheduler count towards job que of first and later stages
+	config3 := NewConfig(1, 3, 10, 0, false, func(ctx context.Context, job event) (event, error) {
+		return job, nil
+	})
+	config3.SerializeByKey = true
+	p3, err := Then(From(config3), config3).Build(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p3.PauseStage(1)
+	for seq := 0; seq < 3; seq++ {
+		if !p3.TrySend(event{"a", seq}) {
+			t.Errorf("expected TrySend of job %d to succeed while job que has space", seq)
+		}
+	}
+	if p3.TrySend(event{"a", 3}) {
+		t.Error("expected TrySend to fail while JobQueueLimit jobs are queued")
+	}
+	if depth := p3.Stats()[0].QueueDepth; depth != 3 {
+		t.Errorf("expected 3 jobs queued in first stage, got %d", depth)
+	}
+	p3.PauseStage(2)
+	p3.ResumeStage(1)
+	time.Sleep(20 * time.Millisecond)
+	if depth := p3.Stats()[1].QueueDepth; depth != 3 {
+		t.Errorf("expected 3 jobs queued in second stage, got %d", depth)
+	}
+	p3.Resume()
+	for range p3.Close() {
+	}
+}
+
+func TestPoolFairByKey(t *testing.T) {
+	started, gate := make(chan struct{}), make(chan struct{})
+	var order []string
+	// job x blocks the only worker until gate is closed
+	config := DefaultConfig(1, func(ctx context.Context, job event) (int, error) {
+		if job.customer == "x" {
+			close(started)
+			<-gate
+		}
+		order = append(order, job.customer+strconv.Itoa(job.seq))
+		return job.seq, nil
+	})
+	config.FairByKey = true
+	config.KeyWeight = func(key string) int {
+		if key == "i" {
+			return 2
+		}
+		return 1
+	}
+	p, err := NewPool(context.Background(), config)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p.SendJobs(event{"x", 0})
+	<-started
+	for seq := 1; seq <= 4; seq++ {
+		p.SendJobs(event{"b", seq})
+	}
+	for seq := 1; seq <= 3; seq++ {
+		p.SendJobs(event{"i", seq})
+	}
+	close(gate)
+	for range p.Close() {
+	}
+	// b1 is picked while x is processed, then i gets 2 jobs per turn
+	if strings.Join(order, ",") != "x0,b1,b2,i1,i2,b3,i3,b4" {
+		t.Errorf("expected jobs in weighted round-robin x0,b1,b2,i1,i2,b3,i3,b4 got %v", order)
+	}
+
+	var mutex sync.Mutex
+	active, peak := map[string]int{}, map[string]int{}
+	config = DefaultConfig(4, func(ctx context.Context, job event) (int, error) {
+		mutex.Lock()
+		if active[job.customer]++; active[job.customer] > peak[job.customer] {
+			peak[job.customer] = active[job.customer]
+		}
+		mutex.Unlock()
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		active[job.customer]--
+		mutex.Unlock()
+		return job.seq, nil
+	})
+	config.FairByKey = true
+	config.MaxPerKey = 2
+	p, err = NewPool(context.Background(), config)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	for seq := 0; seq < 20; seq++ {
+		p.SendJobs(event{"bulk", seq})
+	}
+	p.SendJobs(event{"interactive", 0})
+	count := 0
+	for range p.Close() {
+		count++
+	}
+	if count != 21 || peak["bulk"] != 2 || peak["interactive"] != 1 {
+		t.Errorf("expected 21 results with at most 2 bulk jobs at a time, got %d results and peak %v", count, peak)
+	}
+
+	// jobs waiting for their turn count towards job que
+	config = NewConfig(1, 3, 10, 0, false, func(ctx context.Context, job event) (int, error) {
+		return job.seq, nil
+	})
+	config.FairByKey = true
+	p, err = NewPool(context.Background(), config)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p.Pause()
+	for _, customer := range []string{"a", "b", "a"} {
+		if !p.TrySend(event{customer, 0}) {
+			t.Errorf("expected TrySend of job of %s to succeed while job que has space", customer)
+		}
+	}
+	if p.TrySend(event{"c", 0}) {
+		t.Error("expected TrySend to fail while JobQueueLimit jobs are queued")
+	}
+	if depth := p.Stats()[0].QueueDepth; depth != 3 {
+		t.Errorf("expected 3 jobs queued, got %d", depth)
+	}
+	p.Resume()
+	count = 0
+	for range p.Close() {
+		count++
+	}
+	if count != 3 {
+		t.Errorf("expected 3 results, got %d", count)
+	}
+}
+
+func TestPoolPause(t *testing.T) {
+	var first, second int32
+	b := From(DefaultConfig(2, func(ctx context.Context, job int) (int, error) {
+		atomic.AddInt32(&first, 1)
+		return job, nil
+	}))
+	p, err := Then(b, DefaultConfig(2, func(ctx context.Context, job int) (int, error) {
+		atomic.AddInt32(&second, 1)
+		return job, nil
+	})).Build(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p.Pause()
+	if !p.Paused() || !p.Stats()[0].Paused || !p.Stats()[1].Paused {
+		t.Fatalf("expected all stages paused, got %v", p.Stats())
+	}
+	p.SendJobs(1, 2, 3, 4, 5)
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt32(&first) != 0 || p.Stats()[0].QueueDepth != 5 {
+		t.Fatalf("expected 5 jobs held in que of paused pool, got %d processed and %v", first, p.Stats()[0])
+	}
+	if err = p.ResumeStage(1); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if p.Paused() || atomic.LoadInt32(&first) != 5 || atomic.LoadInt32(&second) != 0 {
+		t.Fatalf("expected only first stage resumed, got %d and %d processed", first, second)
+	}
+	if err = p.PauseStage(3); err == nil {
+		t.Error("expected error for stage that does not exist")
+	}
+	p.Resume()
+	count := 0
+	for range p.Close() {
+		count++
+	}
+	if count != 5 || atomic.LoadInt32(&second) != 5 {
+		t.Errorf("expected 5 results after resume, got %d", count)
+	}
+	if err = p.PauseStage(1); err != ErrPoolClosed {
+		t.Errorf("expected ErrPoolClosed for pausing closed pool, got %v", err)
+	}
+
+	// workers of a paused pool exit once its context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	p, err = NewPool(ctx, DefaultConfig(1, func(ctx context.Context, job int) (int, error) {
+		return job, nil
+	}))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p.Pause()
+	p.SendJobs(1, 2)
+	cancel()
+	for range p.Close() {
+		t.Error("expected no results from cancelled paused pool")
+	}
+	if jobErrors := p.Errors(); len(jobErrors) != 2 {
+		t.Errorf("expected 2 jobs recorded as cancelled, got %v", jobErrors)
+	}
+}
+
+func TestPoolShutdown(t *testing.T) {
+	p, err := NewPool(context.Background(), DefaultConfig(2, func(ctx context.Context, job int) (int, error) {
+		time.Sleep(5 * time.Millisecond)
+		return job, nil
+	}))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p.SendJobs(1, 2, 3, 4, 5)
+	count, drained := 0, make(chan struct{})
+	go func() {
+		defer close(drained)
+		for range p.Close() {
+			count++
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = p.Shutdown(ctx); err != nil {
+		t.Fatalf("expected nil error from graceful shutdown, got %v", err)
+	}
+	<-drained
+	if count != 5 || len(p.Errors()) != 0 {
+		t.Errorf("expected all 5 jobs drained, got %d results and errors %v", count, p.Errors())
+	}
+	if err = p.SendJobsContext(context.Background(), 6); err != ErrPoolClosed {
+		t.Errorf("expected ErrPoolClosed after shutdown, got %v", err)
+	}
+
+	// worker blocks until it is cancelled, remaining jobs are abandoned in que
+	started := make(chan struct{}, 1)
+	p, err = NewPool(context.Background(), DefaultConfig(1, func(ctx context.Context, job int) (int, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p.SendJobs(1, 2, 3, 4)
+	<-started
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err = p.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded from forced shutdown, got %v", err)
+	}
+	select {
+	case _, ok := <-p.Close():
+		if ok {
+			t.Error("expected no results after forced shutdown")
+		}
+	default:
+		t.Fatal("expected results channel to be closed once Shutdown returns")
+	}
+	jobErrors := p.Errors()
+	if len(jobErrors) != 4 {
+		t.Fatalf("expected 4 abandoned jobs, got %v", jobErrors)
+	}
+	for _, jobError := range jobErrors {
+		if !errors.Is(jobError.Err, ErrShutdown) || !errors.Is(jobError.Err, context.Canceled) {
+			t.Errorf("expected JobError with ErrShutdown, got %v", jobError.Err)
+		}
+	}
+
+	// sender blocked on full que of a paused pool does not hold up Shutdown past its deadline
+	p, err = NewPool(context.Background(), NewConfig(1, 1, 1, 0, false, func(ctx context.Context, job int) (int, error) {
+		return job, nil
+	}))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p.Pause()
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		p.SendJobs(1, 2, 3)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- p.Shutdown(ctx)
+	}()
+	select {
+	case err = <-shutdown:
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected context.DeadlineExceeded, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Shutdown to return after its deadline with a blocked sender")
+	}
+	<-sent
+	cancelled, unsent := 0, 0
+	for _, jobError := range p.Errors() {
+		if errors.Is(jobError.Err, ErrShutdown) {
+			cancelled++
+		} else if errors.Is(jobError.Err, ErrPoolClosed) {
+			unsent++
+		}
+	}
+	if cancelled != 1 || unsent != 2 {
+		t.Errorf("expected queued job cancelled and 2 unsent jobs closed, got %v", p.Errors())
+	}
+}
+
+type conn struct {
+	id     int
+	closed bool
+}
+
+func TestPoolStatefulWorker(t *testing.T) {
+	var mutex sync.Mutex
+	var conns []*conn
+	errInit := errors.New("can not connect")
+	failing := 0
+	config := DefaultStatefulConfig(2, func(ctx context.Context, workerID int) (*conn, error) {
+		if workerID == failing {
+			return nil, errInit
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		c := &conn{id: workerID}
+		conns = append(conns, c)
+		return c, nil
+	}, func(ctx context.Context, c *conn, job int) (int, error) {
+		if c.closed {
+			return 0, errors.New("conn closed")
+		}
+		return c.id, nil
+	}, func(c *conn) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		c.closed = true
+	})
+	p, err := NewPool(context.Background(), config)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if err = p.Resize(3); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	failing = 4
+	if err = p.Resize(4); !errors.Is(err, errInit) {
+		t.Errorf("expected init error of worker added by Resize, got %v", err)
+	}
+	if err = p.Resize(1); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	p.SendJobs(1, 2, 3)
+	for result := range p.Close() {
+		if result < 1 || result > 3 {
+			t.Errorf("expected result to be ID of a worker, got %d", result)
+		}
+	}
+	if len(p.Errors()) != 0 {
+		t.Errorf("expected no errors, got %v", p.Errors())
+	}
+	mutex.Lock()
+	if len(conns) != 3 {
+		t.Errorf("expected 3 workers initialized, got %d", len(conns))
+	}
+	for _, c := range conns {
+		if !c.closed {
+			t.Errorf("expected state of worker %d to be closed", c.id)
+		}
+	}
+	conns = nil
+	mutex.Unlock()
+
+	failing = 2
+	if _, err = NewPool(context.Background(), config); !errors.Is(err, errInit) {
+		t.Fatalf("expected init error from NewPool, got %v", err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(conns) != 1 || !conns[0].closed {
+		t.Errorf("expected state of initialized worker to be closed after init failure of other, got %v", conns)
+	}
+
+	noInit := DefaultStatefulConfig[int, int, *conn](1, nil, func(ctx context.Context, c *conn, job int) (int, error) {
+		return c.id, nil
+	}, nil)
+	if _, err = NewPool(context.Background(), noInit); err == nil || !strings.Contains(err.Error(), "Init") {
+		t.Errorf("expected error for nil Init, got %v", err)
+	}
+	noWorker := DefaultStatefulConfig[int, int, *conn](1, func(ctx context.Context, workerID int) (*conn, error) {
+		return &conn{id: workerID}, nil
+	}, nil, nil)
+	if _, err = NewPool(context.Background(), noWorker); err == nil || !strings.Contains(err.Error(), "Worker") {
+		t.Errorf("expected error for nil Worker, got %v", err)
+	}
+}
+
+func TestPoolStatefulWorkerPanic(t *testing.T) {
+	var mutex sync.Mutex
+	var conns []*conn
+	errInit := errors.New("can not connect")
+	failing := false
+	config := DefaultStatefulConfig(1, func(ctx context.Context, workerID int) (*conn, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failing {
+			return nil, errInit
+		}
+		c := &conn{id: len(conns) + 1}
+		conns = append(conns, c)
+		return c, nil
+	}, func(ctx context.Context, c *conn, job int) (int, error) {
+		if c.closed {
+			return 0, errors.New("conn closed")
+		}
+		if job == 0 {
+			panic("broken conn")
+		}
+		return c.id, nil
+	}, func(c *conn) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		c.closed = true
+	})
+	config.HandlePanic = true
+	p, err := NewPool(context.Background(), config)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	future, err := p.Submit(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	var panicErr *PanicError
+	if _, err = future.Wait(context.Background()); !errors.As(err, &panicErr) {
+		t.Errorf("expected PanicError, got %v", err)
+	}
+	mutex.Lock()
+	if len(conns) != 1 || !conns[0].closed {
+		t.Errorf("expected state of panicked worker to be closed, got %v", conns)
+	}
+	mutex.Unlock()
+	future, err = p.Submit(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if result, err := future.Wait(context.Background()); result != 2 || err != nil {
+		t.Errorf("expected job to be processed with state initialized again, got %d and %v", result, err)
+	}
+	// job fails if state can not be initialized again, init is tried again for next job
+	p.SendJobs(0)
+	mutex.Lock()
+	failing = true
+	mutex.Unlock()
+	future, err = p.Submit(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if _, err = future.Wait(context.Background()); !errors.Is(err, errInit) {
+		t.Errorf("expected init error, got %v", err)
+	}
+	mutex.Lock()
+	failing = false
+	mutex.Unlock()
+	future, err = p.Submit(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if result, err := future.Wait(context.Background()); result != 3 || err != nil {
+		t.Errorf("expected job to be processed with state initialized again, got %d and %v", result, err)
+	}
+	for range p.Close() {
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, c := range conns {
+		if !c.closed {
+			t.Errorf("expected state of worker %d to be closed", c.id)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	r := &RetryPolicy{MaxAttempts: 10, InitialDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	expected := []time.Duration{10, 20, 40, 50, 50}
+	for index, want := range expected {
+		if got := r.backoff(index+1, 0); got != want*time.Millisecond {
+			t.Errorf("expected delay after attempt %d to be %s, got %s", index+1, want*time.Millisecond, got)
+		}
+	}
+	// delay without MaxDelay is capped to range of time.Duration
+	uncapped := NewRetryPolicy(100, time.Second, 0)
+	if got := uncapped.backoff(35, 0); got != time.Duration(math.MaxInt64) {
+		t.Errorf("expected delay after attempt 35 without MaxDelay to be %s, got %s", time.Duration(math.MaxInt64), got)
+	}
+	uncapped.Jitter = DecorrelatedJitter
+	if got := uncapped.backoff(2, time.Duration(math.MaxInt64)); got < time.Second {
+		t.Errorf("expected decorrelated delay after max delay to be at least %s, got %s", time.Second, got)
+	}
+	r.MaxElapsed = 5 * time.Millisecond
+	if _, retry := r.next(1, time.Now(), 0, errors.New("some-error")); retry {
+		t.Errorf("expected no retry beyond MaxElapsed")
+	}
+	r.Jitter = DecorrelatedJitter
+	for prev := time.Duration(0); prev < time.Second; prev += 10 * time.Millisecond {
+		if got := r.backoff(2, prev); got < r.InitialDelay || got > r.MaxDelay {
+			t.Errorf("expected decorrelated delay within [%s, %s], got %s", r.InitialDelay, r.MaxDelay, got)
+		}
+	}
+}
+
 func BenchmarkPool(b *testing.B) {
 	tests := []struct{ jobs, workers int }{
 		{10, 5},
@@ -0,0 +1,98 @@
+package pool
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Prioritized can be implemented by job type to set its priority in pools with Config.Priority, jobs with higher
+// priority are processed first
+type Prioritized interface {
+	Priority() int
+}
+
+// queued job in priorityQueue
+type queued[J any] struct {
+	item item[J]
+	// score is priority lowered by time job was queued after start of pool divided by aging
+	score float64
+	seq   uint64
+}
+
+// priorityQueue of jobs with highest score first, jobs with same score are in order they were queued
+type priorityQueue[J any] []queued[J]
+
+func (q priorityQueue[J]) Len() int {
+	return len(q)
+}
+
+func (q priorityQueue[J]) Less(i, j int) bool {
+	if q[i].score != q[j].score {
+		return q[i].score > q[j].score
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q priorityQueue[J]) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *priorityQueue[J]) Push(x any) {
+	*q = append(*q, x.(queued[J]))
+}
+
+func (q *priorityQueue[J]) Pop() any {
+	old := *q
+	last := old[len(old)-1]
+	old[len(old)-1] = queued[J]{}
+	*q = old[:len(old)-1]
+	return last
+}
+
+// prioritize queues up to limit jobs from in and returns channel of queued jobs with highest priority first. With
+// aging priority of a queued job is raised by 1 for every aging duration it waits
+func prioritize[J any](r *run, in <-chan item[J], limit int, aging time.Duration) <-chan item[J] {
+	out := make(chan item[J])
+	r.spawn(func() {
+		defer close(out)
+		started := time.Now()
+		var (
+			queue  priorityQueue[J]
+			seq    uint64
+			closed bool
+		)
+		for {
+			var (
+				jobs <-chan item[J]
+				next chan<- item[J]
+				top  item[J]
+			)
+			if !closed && len(queue) < limit {
+				jobs = in
+			}
+			if len(queue) > 0 {
+				next = out
+				top = queue[0].item
+			}
+			if jobs == nil && next == nil {
+				return
+			}
+			select {
+			case job, ok := <-jobs:
+				if !ok {
+					closed = true
+					continue
+				}
+				score := float64(job.priority)
+				if aging > 0 {
+					score -= float64(time.Since(started)) / float64(aging)
+				}
+				seq++
+				heap.Push(&queue, queued[J]{item: job, score: score, seq: seq})
+			case next <- top:
+				heap.Pop(&queue)
+			}
+		}
+	})
+	return out
+}
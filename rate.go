@@ -0,0 +1,103 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting rate at which workers start jobs, it can be shared by stages of several
+// pools to enforce one limit across them
+type RateLimiter struct {
+	// waits and nanoseconds waited for tokens, first for 64-bit alignment required by atomic
+	waits  uint64
+	waited int64
+	mutex  sync.Mutex
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiterStats of waits for tokens of a RateLimiter
+type RateLimiterStats struct {
+	// Waits is number of times a token was not available right away
+	Waits uint64
+	// Waited is total time spent waiting for tokens
+	Waited time.Duration
+}
+
+// NewRateLimiter returns a new RateLimiter allowing rate jobs per second with bursts of up to burst jobs
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:  rate,
+		burst: burst,
+	}
+}
+
+func (l *RateLimiter) validate() error {
+	if l.rate <= 0 {
+		return errors.New("expected rate of RateLimiter to be more than 0")
+	}
+	if l.burst <= 0 {
+		return errors.New("expected burst of RateLimiter to be more than 0")
+	}
+	return nil
+}
+
+// Wait for a token or ctx to be done
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	_, err := l.wait(ctx)
+	return err
+}
+
+// wait for a token or ctx to be done, returns time waited
+func (l *RateLimiter) wait(ctx context.Context) (time.Duration, error) {
+	delay := l.reserve(time.Now())
+	if delay == 0 {
+		return 0, nil
+	}
+	started := time.Now()
+	err := sleep(ctx, delay)
+	waited := time.Since(started)
+	atomic.AddUint64(&l.waits, 1)
+	atomic.AddInt64(&l.waited, int64(waited))
+	if err != nil {
+		l.cancel()
+	}
+	return waited, err
+}
+
+// reserve a token, returns delay until it is available
+func (l *RateLimiter) reserve(now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.last.IsZero() {
+		l.tokens = float64(l.burst)
+	} else if l.tokens += now.Sub(l.last).Seconds() * l.rate; l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel reservation of a token that was not used
+func (l *RateLimiter) cancel() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.tokens++
+}
+
+// Stats of waits for tokens across all stages sharing the RateLimiter
+func (l *RateLimiter) Stats() RateLimiterStats {
+	return RateLimiterStats{
+		Waits:  atomic.LoadUint64(&l.waits),
+		Waited: time.Duration(atomic.LoadInt64(&l.waited)),
+	}
+}
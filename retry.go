@@ -0,0 +1,138 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Jitter strategy applied to retry delays
+type Jitter int
+
+const (
+	// NoJitter uses computed exponential delay as is
+	NoJitter Jitter = iota
+	// FullJitter picks a random delay between 0 and computed exponential delay
+	FullJitter
+	// DecorrelatedJitter picks a random delay between InitialDelay and 3 times the previous delay
+	DecorrelatedJitter
+)
+
+// RetryPolicy for failed jobs, unlike Config.MaxRetry every job gets its own attempt budget
+type RetryPolicy struct {
+	// MaxAttempts per job including the first attempt, 0 or 1 disables retries
+	MaxAttempts int
+	// InitialDelay before the first retry
+	InitialDelay time.Duration
+	// Multiplier applied to delay after every retry, defaults to 2 when 0
+	Multiplier float64
+	// MaxDelay caps delay between two attempts, 0 means no cap
+	MaxDelay time.Duration
+	// MaxElapsed caps total time spent on a job including delays, 0 means no cap
+	MaxElapsed time.Duration
+	// Jitter strategy applied to delays
+	Jitter Jitter
+}
+
+// NewRetryPolicy returns a new RetryPolicy with exponential backoff doubling from initialDelay up to maxDelay
+func NewRetryPolicy(maxAttempts int, initialDelay, maxDelay time.Duration) *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:  maxAttempts,
+		InitialDelay: initialDelay,
+		Multiplier:   2,
+		MaxDelay:     maxDelay,
+		Jitter:       NoJitter,
+	}
+}
+
+func (r *RetryPolicy) validate() error {
+	if r.MaxAttempts < 0 {
+		return errors.New("expected RetryPolicy.MaxAttempts to be 0 or more")
+	}
+	if r.InitialDelay < 0 || r.MaxDelay < 0 || r.MaxElapsed < 0 {
+		return errors.New("expected RetryPolicy delays to be 0 or more")
+	}
+	if r.Multiplier != 0 && r.Multiplier < 1 {
+		return errors.New("expected RetryPolicy.Multiplier to be 1 or more")
+	}
+	if r.Jitter < NoJitter || r.Jitter > DecorrelatedJitter {
+		return errors.New("expected RetryPolicy.Jitter to be one of NoJitter, FullJitter, DecorrelatedJitter")
+	}
+	return nil
+}
+
+// backoff returns delay before the next attempt after given number of attempts, prev is the previous delay
+func (r *RetryPolicy) backoff(attempts int, prev time.Duration) time.Duration {
+	multiplier := r.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	var delay time.Duration
+	switch r.Jitter {
+	case DecorrelatedJitter:
+		upper := 3 * prev
+		if prev > math.MaxInt64/3 {
+			upper = math.MaxInt64
+		}
+		if upper <= r.InitialDelay {
+			delay = r.InitialDelay
+		} else {
+			delay = r.InitialDelay + time.Duration(rand.Int63n(int64(upper-r.InitialDelay)))
+		}
+	default:
+		d := float64(r.InitialDelay)
+		for i := 1; i < attempts; i++ {
+			d *= multiplier
+			if r.MaxDelay > 0 && d >= float64(r.MaxDelay) || d >= math.MaxInt64 {
+				break
+			}
+		}
+		delay = time.Duration(d)
+		if d >= math.MaxInt64 {
+			// delay beyond range of time.Duration overflows on conversion
+			delay = math.MaxInt64
+		}
+		if r.MaxDelay > 0 && d >= float64(r.MaxDelay) {
+			delay = r.MaxDelay
+		}
+		if r.Jitter == FullJitter && delay > 0 {
+			delay = time.Duration(rand.Int63n(int64(delay)))
+		}
+	}
+	if r.MaxDelay > 0 && delay > r.MaxDelay {
+		delay = r.MaxDelay
+	}
+	return delay
+}
+
+// next reports if another attempt is allowed after err and delay before it
+func (r *RetryPolicy) next(attempts int, started time.Time, prev time.Duration, err error) (time.Duration, bool) {
+	if attempts >= r.MaxAttempts {
+		return 0, false
+	}
+	delay, ok := retryAfter(err)
+	if !ok {
+		delay = r.backoff(attempts, prev)
+	}
+	if r.MaxElapsed > 0 && time.Since(started)+delay > r.MaxElapsed {
+		return 0, false
+	}
+	return delay, true
+}
+
+// sleep for given duration or until context is done
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
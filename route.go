@@ -0,0 +1,192 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Router returns index of the branch a result is routed to
+type Router[T any] func(result T) int
+
+// Route returns a new Builder with a stage added to b that sends every result of b to one of branches picked by
+// router, results of all branches are merged into one results channel. A result for which router returns an index
+// out of range is recorded as JobError with ErrNoRoute.
+//
+// Stages of branches are numbered after the route stage in order of branches, Config.Ordered of branches is ignored
+//
+//	images := pool.Then(pool.From(resize), compress)
+//	videos := pool.From(transcode)
+//	b := pool.Then(pool.Route(pool.From(fetch), func(m Media) int { return m.Kind }, images, videos), upload)
+func Route[J, T, R any](b *Builder[J, T], router Router[T], branches ...*Builder[T, R]) *Builder[J, R] {
+	next := fork(b, "route", router, branches)
+	next.validators = append(next.validators, func() error {
+		if router == nil {
+			return errors.New("expected router to be not nil")
+		}
+		return nil
+	})
+	return next
+}
+
+// Tee returns a new Builder with a stage added to b that sends every result of b to all branches, results of all
+// branches are merged into one results channel. Branches receive the same value which they should not modify.
+//
+// Future of a submitted job resolves with the first result of any branch, errors of branches resolve it once all
+// copies of the job are accounted for.
+//
+// Stages of branches are numbered after the tee stage in order of branches, Config.Ordered of branches is ignored
+func Tee[J, T, R any](b *Builder[J, T], branches ...*Builder[T, R]) *Builder[J, R] {
+	next := fork(b, "tee", nil, branches)
+	next.first.tee = true
+	return next
+}
+
+// fork adds stage named name to b that sends results of b to branches picked by router or to all branches if
+// router is nil
+func fork[J, T, R any](b *Builder[J, T], name string, router Router[T], branches []*Builder[T, R]) *Builder[J, R] {
+	next := &Builder[J, R]{
+		validators: append(append([]func() error(nil), b.validators...), func() error {
+			if len(branches) == 0 {
+				return fmt.Errorf("expected %s to have at least one branch", name)
+			}
+			return nil
+		}),
+		names: append(append([]string(nil), b.names...), name),
+		first: b.first,
+	}
+	stage := len(next.names)
+	startable := b.start != nil
+	for _, branch := range branches {
+		if branch == nil {
+			next.validators = append(next.validators, func() error {
+				return errors.New("expected branch to be not nil")
+			})
+			startable = false
+			continue
+		}
+		next.validators = append(next.validators, branch.validators...)
+		next.first.tee = next.first.tee || branch.first.tee
+		next.names = append(next.names, branch.names...)
+		if branch.resultQueueLimit > next.resultQueueLimit {
+			next.resultQueueLimit = branch.resultQueueLimit
+		}
+		startable = startable && branch.start != nil
+	}
+	if !startable {
+		return next
+	}
+	next.start = func(r *run, jobs <-chan item[J], last bool) <-chan item[R] {
+		return startFork(r, r.stage(stage), name, b.start(r, jobs, false), router, branches)
+	}
+	return next
+}
+
+// startFork starts branches and returns channel of their merged results
+func startFork[T, R any](r *run, stage int, name string, in <-chan item[T], router Router[T], branches []*Builder[T, R]) <-chan item[R] {
+	out := make(chan item[R])
+	inputs := make([]chan item[T], len(branches))
+	var wg sync.WaitGroup
+	offset := stage
+	for index, branch := range branches {
+		inputs[index] = make(chan item[T], branch.first.jobQueueLimit)
+		branchRun := *r
+		branchRun.offset = offset
+		offset += len(branch.names)
+		results := branch.start(&branchRun, inputs[index], false)
+		wg.Add(1)
+		r.spawn(func() {
+			defer wg.Done()
+			for result := range results {
+				if !send(r.ctx, out, result) && !result.skip {
+					r.errors.add(r.ctx, JobError{Job: result.value, JobID: result.id, Stage: stage, StageName: name, Err: r.ctx.Err(), Failed: time.Now()})
+				}
+			}
+		})
+	}
+	// skip passes on interval of job that is not sent to any branch in ordered pools
+	skip := func(next item[T]) {
+		if r.ordered {
+			send(r.ctx, out, item[R]{id: next.id, ctx: next.ctx, offset: next.offset, weight: next.weight, skip: true})
+			for _, part := range next.batched() {
+				send(r.ctx, out, skipped[R](part))
+			}
+		}
+	}
+	dispatch := func(index int, next item[T]) {
+		if !send(r.ctx, inputs[index], next) {
+			r.errors.add(r.ctx, JobError{Job: next.value, JobID: next.id, Stage: stage, StageName: name, Err: r.ctx.Err(), Failed: time.Now()})
+			skip(next)
+		}
+	}
+	wg.Add(1)
+	r.spawn(func() {
+		defer wg.Done()
+		defer func() {
+			for _, input := range inputs {
+				close(input)
+			}
+		}()
+		for next := range in {
+			switch {
+			case next.skip:
+				skip(next)
+			case router != nil:
+				index := router(next.value)
+				if index < 0 || index >= len(inputs) {
+					r.errors.add(r.ctx, JobError{Job: next.value, JobID: next.id, Stage: stage, StageName: name, Err: fmt.Errorf("%w: branch %d", ErrNoRoute, index), Failed: time.Now()})
+					skip(next)
+					continue
+				}
+				dispatch(index, next)
+			default:
+				for index := range inputs {
+					dispatch(index, tee(r, next, len(inputs), index))
+				}
+			}
+		}
+	})
+	r.spawn(func() {
+		wg.Wait()
+		close(out)
+	})
+	return out
+}
+
+// tee returns copy of next for one of n branches, in ordered pools interval of next is split between copies and
+// parts of a batch are passed only with the first copy
+func tee[T any](r *run, next item[T], n, index int) item[T] {
+	if !r.ordered {
+		return next
+	}
+	copied := next
+	copied.offset, copied.weight = next.split(n, index)
+	copied.parts = nil
+	if index == 0 && len(next.parts) > 0 {
+		copied.parts = append([]part{{id: next.id, ctx: next.ctx, offset: copied.offset, weight: copied.weight}}, next.parts[1:]...)
+	}
+	return copied
+}
+
+// Merge results channels of several pools into one channel which is closed once all of them are closed. Once ctx
+// is done remaining results are discarded so pools can complete
+func Merge[R any](ctx context.Context, results ...<-chan R) <-chan R {
+	out := make(chan R)
+	var wg sync.WaitGroup
+	wg.Add(len(results))
+	for _, ch := range results {
+		go func(ch <-chan R) {
+			defer wg.Done()
+			for result := range ch {
+				send(ctx, out, result)
+			}
+		}(ch)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
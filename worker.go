@@ -0,0 +1,96 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// workerInit of a group of workers, collects first error of workers that failed to init
+type workerInit struct {
+	wait  sync.WaitGroup
+	mutex sync.Mutex
+	err   error
+}
+
+func newWorkerInit(n int) *workerInit {
+	init := &workerInit{}
+	init.wait.Add(n)
+	return init
+}
+
+// done with init of a worker
+func (w *workerInit) done(err error) {
+	if err != nil {
+		w.mutex.Lock()
+		if w.err == nil {
+			w.err = err
+		}
+		w.mutex.Unlock()
+	}
+	w.wait.Done()
+}
+
+// result waits for init of all workers of the group and returns first error
+func (w *workerInit) result() error {
+	w.wait.Wait()
+	return w.err
+}
+
+// initWorker with given ID, returns worker and func closing its state. Panic in init is returned as *PanicError with
+// HandlePanic
+func (p *singleStagePool[J, R]) initWorker(id int) (worker func(context.Context, J) (R, error), closeWorker func(), err error) {
+	if p.newWorker == nil {
+		return p.Worker, func() {}, nil
+	}
+	if p.HandlePanic {
+		defer func() {
+			if r := recover(); r != nil {
+				err = &PanicError{Value: r, Stack: debug.Stack()}
+			}
+		}()
+	}
+	return p.newWorker(p.ctx, id)
+}
+
+// statefulWorker invokes worker with its own state. With HandlePanic state of a worker whose job panicked is closed
+// and initialized again before its next invocation
+type statefulWorker[J, R any] struct {
+	pool   *singleStagePool[J, R]
+	id     int
+	worker func(context.Context, J) (R, error)
+	close  func()
+}
+
+// invoke worker with job, state closed after a panic is initialized first. Init failure fails the job
+func (w *statefulWorker[J, R]) invoke(ctx context.Context, job J) (result R, err error) {
+	if w.worker == nil {
+		worker, closeWorker, err := w.pool.initWorker(w.id)
+		if err != nil {
+			return result, Permanent(fmt.Errorf("worker %d of stage %d failed to init: %w", w.id, w.pool.stage, err))
+		}
+		w.worker, w.close = worker, closeWorker
+	}
+	if w.pool.HandlePanic {
+		panicked := true
+		defer func() {
+			// state may be left inconsistent by the panic
+			if panicked {
+				w.closeState()
+			}
+		}()
+		result, err = w.worker(ctx, job)
+		panicked = false
+		return result, err
+	}
+	return w.worker(ctx, job)
+}
+
+// closeState of the worker if it is initialized
+func (w *statefulWorker[J, R]) closeState() {
+	if w.worker != nil {
+		w.close()
+		w.worker, w.close = nil, nil
+	}
+}